@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Administrators are the users listed in FAMONEY_ADMINS, a comma separated
+// list of usernames, and the users granted the role in the admin console.
+// The environment variable is how the first administrator is set up; it
+// cannot be revoked from the console.
+
+var (
+	errSelf     = errors.New("ErrSelf")
+	errDisabled = errors.New("ErrDisabled")
+)
+
+// envAdmin reports whether username is listed in FAMONEY_ADMINS.
+func envAdmin(username string) bool {
+	for _, name := range strings.Split(os.Getenv("FAMONEY_ADMINS"), ",") {
+		if name = strings.TrimSpace(name); name != "" && name == username {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdmin reports whether uid may use the admin pages.
+func isAdmin(uid int) bool {
+	var username string
+	var granted bool
+	if err := db.QueryRow("SELECT username, is_admin FROM users WHERE id=? AND status=?", uid, userActive).Scan(&username, &granted); err != nil {
+		return false
+	}
+	return granted || envAdmin(username)
+}
+
+// adminAuth is auth for pages restricted to administrators; everyone else
+// gets a 404 so the pages are not advertised.
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return auth(func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(currentUser(r)) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminUser is a row of the user list in the admin console.
+type AdminUser struct {
+	ID        int
+	Username  string
+	Status    string
+	Admin     bool
+	EnvAdmin  bool
+	CreatedAt *time.Time
+	Wallets   int
+	Flows     int
+	Sessions  int
+	LastSeen  *time.Time
+}
+
+func listUsers() ([]*AdminUser, error) {
+	rows, err := db.Query(`SELECT u.id, u.username, u.status, u.is_admin, u.created_at,
+		(SELECT COUNT(*) FROM wallet_owners o WHERE o.user_id=u.id),
+		(SELECT COUNT(*) FROM flows f WHERE f.operator_id=u.id)
+		FROM users u ORDER BY u.username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*AdminUser{}
+	for rows.Next() {
+		u := &AdminUser{}
+		if err := rows.Scan(&u.ID, &u.Username, &u.Status, &u.Admin, &u.CreatedAt, &u.Wallets, &u.Flows); err != nil {
+			return nil, err
+		}
+		u.EnvAdmin = envAdmin(u.Username)
+		list = append(list, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, u := range list {
+		active, err := sessions.List(u.ID)
+		if err != nil {
+			return nil, err
+		}
+		u.Sessions = len(active)
+		if len(active) > 0 {
+			u.LastSeen = &active[0].LastSeen
+		}
+	}
+	return list, nil
+}
+
+// TableUsage is the disk space taken by one database table. Row counts and
+// sizes are the estimates MySQL keeps in information_schema.
+type TableUsage struct {
+	Name  string
+	Rows  int64
+	Bytes int64
+}
+
+// Size formats Bytes for display.
+func (t *TableUsage) Size() string {
+	return formatBytes(t.Bytes)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func storageUsage() ([]*TableUsage, int64, error) {
+	rows, err := db.Query("SELECT TABLE_NAME, IFNULL(TABLE_ROWS, 0), IFNULL(DATA_LENGTH, 0) + IFNULL(INDEX_LENGTH, 0) FROM information_schema.TABLES WHERE TABLE_SCHEMA=DATABASE() ORDER BY 3 DESC")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	list := []*TableUsage{}
+	var total int64
+	for rows.Next() {
+		t := &TableUsage{}
+		if err := rows.Scan(&t.Name, &t.Rows, &t.Bytes); err != nil {
+			return nil, 0, err
+		}
+		total += t.Bytes
+		list = append(list, t)
+	}
+	return list, total, rows.Err()
+}
+
+// RateStatus describes where the exchange rates in use come from.
+type RateStatus struct {
+	Providers  string
+	Source     string
+	Updated    time.Time
+	Fetched    time.Time
+	Attempted  time.Time
+	Error      string
+	Currencies int
+	Overrides  int
+}
+
+func rateStatus() *RateStatus {
+	ratesMu.RLock()
+	st := &RateStatus{
+		Providers:  rateProviders.Name(),
+		Source:     ratesSource,
+		Updated:    ratesUpdated,
+		Fetched:    ratesFetched,
+		Attempted:  ratesAttempt,
+		Error:      ratesFetchErr,
+		Currencies: len(currencyRates),
+	}
+	ratesMu.RUnlock()
+	now := time.Now()
+	overridesMu.RLock()
+	for _, o := range rateOverrides {
+		if o.ActiveOn(now) {
+			st.Overrides++
+		}
+	}
+	overridesMu.RUnlock()
+	return st
+}
+
+// resetPassword gives uid a random password, returned to show to the
+// administrator once, and ends all of their sessions.
+func resetPassword(uid int) (string, error) {
+	pw, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	pw = pw[:16]
+	h, err := hashPassword(pw)
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.Exec("UPDATE users SET password=? WHERE id=?", h, uid); err != nil {
+		return "", err
+	}
+	return pw, sessions.DeleteUser(uid)
+}
+
+// setUserStatus disables or re-enables an account. Disabling also logs the
+// user out everywhere.
+func setUserStatus(uid int, status string) error {
+	from := userActive
+	if status == userActive {
+		from = userDisabled
+	}
+	if _, err := db.Exec("UPDATE users SET status=? WHERE id=? AND status=?", status, uid, from); err != nil {
+		return err
+	}
+	if status == userDisabled {
+		return sessions.DeleteUser(uid)
+	}
+	return nil
+}
+
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	self := currentUser(r)
+	data := map[string]interface{}{}
+	if r.Method == "POST" {
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		action := r.FormValue("action")
+		var err error
+		switch action {
+		case "reset_password":
+			var pw string
+			if pw, err = resetPassword(id); err == nil {
+				var username string
+				db.QueryRow("SELECT username FROM users WHERE id=?", id).Scan(&username)
+				data["ResetUser"] = username
+				data["ResetPassword"] = pw
+			}
+		case "disable", "revoke_admin":
+			if id == self {
+				err = errSelf
+			} else if action == "disable" {
+				err = setUserStatus(id, userDisabled)
+			} else {
+				_, err = db.Exec("UPDATE users SET is_admin=0 WHERE id=?", id)
+			}
+		case "enable":
+			err = setUserStatus(id, userActive)
+		case "grant_admin":
+			_, err = db.Exec("UPDATE users SET is_admin=1 WHERE id=?", id)
+		case "logout":
+			err = sessions.DeleteUser(id)
+			if err == nil && id == self {
+				clearSessionCookie(w, r)
+				http.Redirect(w, r, "/famoney/login", http.StatusSeeOther)
+				return
+			}
+		case "refresh_rates":
+			updateCurrencyRates()
+		}
+		if err != nil {
+			http.Redirect(w, r, "/famoney/admin?err="+errorKey(err), http.StatusSeeOther)
+			return
+		}
+		if data["ResetPassword"] == nil {
+			http.Redirect(w, r, "/famoney/admin", http.StatusSeeOther)
+			return
+		}
+	}
+	users, err := listUsers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tables, total, err := storageUsage()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data["Users"] = users
+	data["Self"] = self
+	data["Tables"] = tables
+	data["TotalSize"] = formatBytes(total)
+	data["Rates"] = rateStatus()
+	if errKey := r.URL.Query().Get("err"); errKey != "" {
+		if _, ok := translations["en"][errKey]; ok {
+			data["Error"] = errKey
+		}
+	}
+	render(w, r, "admin.html", data)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A budget limits what a household spends in a category over a month, a
+// quarter or a year; on an income category it is a target instead. It can
+// be limited to some of the household's wallets and otherwise covers all
+// of them. Actual amounts include the subcategories and are converted to
+// the base currency like the other reports, over the wallets shared with
+// the member looking at them.
+//
+// With rollover, what is left of a period's budget is added to the next
+// one. Overspending is not carried over.
+
+const (
+	periodMonth   = "monthly"
+	periodQuarter = "quarterly"
+	periodYear    = "yearly"
+)
+
+var budgetPeriods = []string{periodMonth, periodQuarter, periodYear}
+
+// periodKeys maps periods to their translation keys.
+var periodKeys = map[string]string{
+	periodMonth:   "Monthly",
+	periodQuarter: "Quarterly",
+	periodYear:    "Yearly",
+}
+
+var errBudget = errors.New("ErrBudget")
+
+// periodStart returns the first day of the period containing t.
+func periodStart(t time.Time, period string) time.Time {
+	y, m, _ := t.Date()
+	switch period {
+	case periodQuarter:
+		m = (m-1)/3*3 + 1
+	case periodYear:
+		m = time.January
+	}
+	return time.Date(y, m, 1, 0, 0, 0, 0, time.Local)
+}
+
+// nextPeriod returns the start of the period after the one at start.
+func nextPeriod(start time.Time, period string) time.Time {
+	switch period {
+	case periodQuarter:
+		return start.AddDate(0, 3, 0)
+	case periodYear:
+		return start.AddDate(1, 0, 0)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+// Budget is a budget with its figures for the current period, all in the
+// base currency.
+type Budget struct {
+	ID         int
+	CategoryID int
+	Category   *Category
+	Period     string
+	Amount     int64
+	Currency   string
+	Rollover   bool
+	StartsOn   time.Time
+	WalletIDs  []int
+	Wallets    []string
+
+	From   time.Time
+	To     time.Time
+	Limit  int64
+	Carry  int64
+	Actual int64
+}
+
+// Available is the budget of the current period including rollover.
+func (b *Budget) Available() int64 { return b.Limit + b.Carry }
+
+// Remaining is what is left of Available.
+func (b *Budget) Remaining() int64 { return b.Available() - b.Actual }
+
+// Percent is Actual as a percentage of Available.
+func (b *Budget) Percent() int64 {
+	if b.Available() <= 0 {
+		if b.Actual > 0 {
+			return 100
+		}
+		return 0
+	}
+	return b.Actual * 100 / b.Available()
+}
+
+// Width is Percent clamped for a progress bar.
+func (b *Budget) Width() int64 {
+	p := b.Percent()
+	if p < 0 {
+		return 0
+	}
+	if p > 100 {
+		return 100
+	}
+	return p
+}
+
+// Income reports whether the budget is a target on an income category.
+func (b *Budget) Income() bool { return b.Category != nil && b.Category.Kind == catIncome }
+
+// Over reports whether an expense budget is exceeded.
+func (b *Budget) Over() bool { return !b.Income() && b.Actual > b.Available() }
+
+// Reached reports whether an income target is met.
+func (b *Budget) Reached() bool { return b.Income() && b.Actual >= b.Available() }
+
+// LastDay is the last day of the current period.
+func (b *Budget) LastDay() time.Time { return b.To.AddDate(0, 0, -1) }
+
+func householdBudgets(hid int) ([]*Budget, error) {
+	rows, err := db.Query("SELECT id, category_id, period, amount, currency, rollover, starts_on FROM budgets WHERE household_id=? ORDER BY id", hid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*Budget{}
+	byID := map[int]*Budget{}
+	for rows.Next() {
+		b := &Budget{}
+		if err := rows.Scan(&b.ID, &b.CategoryID, &b.Period, &b.Amount, &b.Currency, &b.Rollover, &b.StartsOn); err != nil {
+			return nil, err
+		}
+		list = append(list, b)
+		byID[b.ID] = b
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	wrows, err := db.Query("SELECT bw.budget_id, w.id, w.name FROM budget_wallets bw JOIN budgets b ON bw.budget_id=b.id JOIN wallets w ON bw.wallet_id=w.id WHERE b.household_id=? ORDER BY w.name", hid)
+	if err != nil {
+		return nil, err
+	}
+	defer wrows.Close()
+	for wrows.Next() {
+		var bid, wid int
+		var name string
+		if err := wrows.Scan(&bid, &wid, &name); err != nil {
+			return nil, err
+		}
+		if b := byID[bid]; b != nil {
+			b.WalletIDs = append(b.WalletIDs, wid)
+			b.Wallets = append(b.Wallets, name)
+		}
+	}
+	return list, wrows.Err()
+}
+
+// evaluateBudgets fills in the current period of each budget of hid from
+// totals, the normal flows of the wallets the viewer can see.
+func evaluateBudgets(hid int, budgets []*Budget, tree []*Category, totals []*flowTotal, base, valuation string, now time.Time) {
+	byID := map[int]*Category{}
+	for _, c := range tree {
+		byID[c.ID] = c
+	}
+	for _, b := range budgets {
+		b.Category = byID[b.CategoryID]
+		b.From = periodStart(now, b.Period)
+		b.To = nextPeriod(b.From, b.Period)
+		b.Limit = convertMoney(hid, b.Amount, b.Currency, base)
+		sign := int64(-1)
+		if b.Income() {
+			sign = 1
+		}
+		scope := map[int]bool{}
+		for _, wid := range b.WalletIDs {
+			scope[wid] = true
+		}
+		actual := map[time.Time]int64{}
+		for _, t := range totals {
+			if len(scope) > 0 && !scope[t.WalletID] {
+				continue
+			}
+			for _, cid := range withAncestors(t.CategoryID, byID) {
+				if cid == b.CategoryID {
+					day := time.Date(t.Day.Year(), t.Day.Month(), t.Day.Day(), 0, 0, 0, 0, time.Local)
+					actual[periodStart(day, b.Period)] += sign * t.Value(hid, base, valuation)
+					break
+				}
+			}
+		}
+		b.Actual = actual[b.From]
+		b.Carry = 0
+		if b.Rollover && sign < 0 {
+			for p := periodStart(b.StartsOn, b.Period); p.Before(b.From); p = nextPeriod(p, b.Period) {
+				if b.Carry += b.Limit - actual[p]; b.Carry < 0 {
+					b.Carry = 0
+				}
+			}
+		}
+	}
+}
+
+// budgetHousehold returns the household of a budget, or 0.
+func budgetHousehold(id int) int {
+	var hid int
+	db.QueryRow("SELECT household_id FROM budgets WHERE id=?", id).Scan(&hid)
+	return hid
+}
+
+// createBudget adds a budget for a category of hid. walletIDs limit it to
+// those wallets, which must be in the household and shared with uid.
+func createBudget(uid, hid, categoryID int, period string, amount int64, cur string, rollover bool, walletIDs []int) error {
+	if !isMember(uid, hid) {
+		return errNotMember
+	}
+	if _, ok := periodKeys[period]; !ok || categoryHousehold(categoryID) != hid {
+		return errBudget
+	}
+	if amount <= 0 {
+		return errInvalidAmount
+	}
+	if !knownCurrency(cur) {
+		return errCurrency
+	}
+	for _, wid := range walletIDs {
+		if walletHousehold(wid) != hid || !ownsWallet(uid, wid) {
+			return errBudget
+		}
+	}
+	return withTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec("INSERT INTO budgets (household_id, category_id, period, amount, currency, rollover, starts_on, created_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", hid, categoryID, period, amount, cur, rollover, periodStart(time.Now(), period), uid)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for _, wid := range walletIDs {
+			if _, err := tx.Exec("INSERT IGNORE INTO budget_wallets (budget_id, wallet_id) VALUES (?, ?)", id, wid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// updateBudget changes the amount and rollover of a budget.
+func updateBudget(uid, id int, amount int64, rollover bool) error {
+	if hid := budgetHousehold(id); hid == 0 || !isMember(uid, hid) {
+		return errBudget
+	}
+	if amount <= 0 {
+		return errInvalidAmount
+	}
+	_, err := db.Exec("UPDATE budgets SET amount=?, rollover=? WHERE id=?", amount, rollover, id)
+	return err
+}
+
+func deleteBudget(uid, id int) error {
+	if hid := budgetHousehold(id); hid == 0 || !isMember(uid, hid) {
+		return errBudget
+	}
+	return withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM budget_wallets WHERE budget_id=?", id); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM budgets WHERE id=?", id)
+		return err
+	})
+}
+
+func budgetsHandler(w http.ResponseWriter, r *http.Request) {
+	uid := currentUser(r)
+	hid := currentHousehold(w, r)
+	if r.Method == "POST" {
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		cur := r.FormValue("currency")
+		rollover := r.FormValue("rollover") != ""
+		var err error
+		switch r.FormValue("action") {
+		case "create":
+			categoryID, _ := strconv.Atoi(r.FormValue("category"))
+			var walletIDs []int
+			for _, v := range r.Form["wallet"] {
+				if wid, _ := strconv.Atoi(v); wid != 0 {
+					walletIDs = append(walletIDs, wid)
+				}
+			}
+			var amount int64
+			if amount, err = parseMoney(r.FormValue("amount"), cur); err == nil {
+				err = createBudget(uid, hid, categoryID, r.FormValue("period"), amount, cur, rollover, walletIDs)
+			}
+		case "update":
+			db.QueryRow("SELECT currency FROM budgets WHERE id=?", id).Scan(&cur)
+			var amount int64
+			if amount, err = parseMoney(r.FormValue("amount"), cur); err == nil {
+				err = updateBudget(uid, id, amount, rollover)
+			}
+		case "delete":
+			err = deleteBudget(uid, id)
+		}
+		if err != nil {
+			http.Redirect(w, r, "/famoney/budgets?err="+errorKey(err), http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/famoney/budgets", http.StatusSeeOther)
+		return
+	}
+	base := getBaseCurrency(w, r)
+	valuation := getValuation(w, r)
+	tree, err := householdCategories(hid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	budgets, err := householdBudgets(hid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	walletRows, err := db.Query("SELECT w.id, w.name FROM wallets w JOIN wallet_owners o ON w.id=o.wallet_id WHERE o.user_id=? AND w.household_id=? ORDER BY o.display_order, w.id", uid, hid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer walletRows.Close()
+	wallets := []*Wallet{}
+	walletIDs := []int{}
+	for walletRows.Next() {
+		wl := &Wallet{}
+		if err := walletRows.Scan(&wl.ID, &wl.Name); err == nil {
+			wallets = append(wallets, wl)
+			walletIDs = append(walletIDs, wl.ID)
+		}
+	}
+	totals, err := queryFlowTotals(walletIDs, flowNormal)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	evaluateBudgets(hid, budgets, tree, totals, base, valuation, time.Now())
+	data := map[string]interface{}{
+		"Budgets":    budgets,
+		"Categories": tree,
+		"Wallets":    wallets,
+		"Periods":    budgetPeriods,
+		"PeriodKeys": periodKeys,
+		"KindKeys":   categoryKindKeys,
+	}
+	if errKey := r.URL.Query().Get("err"); errKey != "" {
+		if _, ok := translations["en"][errKey]; ok {
+			data["Error"] = errKey
+		}
+	}
+	render(w, r, "budgets.html", data)
+}
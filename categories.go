@@ -0,0 +1,587 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Categories belong to a household and are shared by all of its members;
+// someone keeping their money alone works in their personal household, so
+// their categories are theirs only. A flow may only be booked against a
+// category of its wallet's household, and every category query is limited
+// to one household.
+//
+// Categories form a tree of any depth through parent_id. Reports roll the
+// totals of subcategories up into their parents, and moving a category
+// takes its whole subtree along.
+//
+// Names are unique among the subcategories of one parent, and among the
+// top-level categories of a household; changes that would repeat a name
+// fail with errCatExists.
+//
+// Every category has a kind. Amounts are entered without a sign and the
+// kind decides it: income is booked as a positive flow and expenses as a
+// negative one. Transfer and adjustment categories keep the sign as typed;
+// they cover money moved to accounts outside FaMoney and corrections, and
+// reports list them apart from income and expenses. A subcategory always
+// has the kind of its top-level category. Flows keep the sign they were
+// booked with, so a category's kind can only change while neither it nor
+// its subcategories have flows of another kind.
+
+const (
+	catIncome     = "income"
+	catExpense    = "expense"
+	catTransfer   = "transfer"
+	catAdjustment = "adjustment"
+)
+
+// categoryKinds lists the kinds in the order of the category form and the
+// report sections.
+var categoryKinds = []string{catIncome, catExpense, catTransfer, catAdjustment}
+
+// categoryKindKeys maps kinds to their translation keys.
+var categoryKindKeys = map[string]string{
+	catIncome:     "KindIncome",
+	catExpense:    "KindExpense",
+	catTransfer:   "KindTransfer",
+	catAdjustment: "KindAdjust",
+}
+
+var (
+	errCategory   = errors.New("ErrCategory")
+	errCatCycle   = errors.New("ErrCatCycle")
+	errCatKind    = errors.New("ErrCatKind")
+	errCatKindMix = errors.New("ErrCatKindMix")
+	errCatInUse   = errors.New("ErrCatInUse")
+	errCatExists  = errors.New("ErrCatExists")
+	errCatFlows   = errors.New("ErrCatFlows")
+	errBalanceCat = errors.New("ErrBalanceCat")
+)
+
+// defaultCategories are the translation keys and kinds of the categories a
+// new household starts with, named in the language of its creator.
+var defaultCategories = []struct{ Key, Kind string }{
+	{"CatFood", catExpense}, {"CatHousing", catExpense},
+	{"CatTransport", catExpense}, {"CatShopping", catExpense},
+	{"CatHealth", catExpense}, {"CatLeisure", catExpense},
+	{"CatSalary", catIncome}, {"CatOther", catExpense},
+}
+
+// seedCategories adds the default categories to a new household.
+func seedCategories(tx *sql.Tx, hid int, lang string) error {
+	for _, c := range defaultCategories {
+		if _, err := tx.Exec("INSERT IGNORE INTO categories (name, household_id, kind) VALUES (?, ?, ?)", T(lang, c.Key), hid, c.Kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validKind(kind string) bool {
+	_, ok := categoryKindKeys[kind]
+	return ok
+}
+
+// signedAmount gives amount the sign of the kind of categoryID. Flows
+// without a category keep the amount as entered.
+func signedAmount(tx *sql.Tx, categoryID int, amount int64) (int64, error) {
+	if amount == 0 {
+		return 0, errInvalidAmount
+	}
+	if categoryID == 0 {
+		return amount, nil
+	}
+	var kind string
+	if err := tx.QueryRow("SELECT kind FROM categories WHERE id=?", categoryID).Scan(&kind); err != nil {
+		return 0, err
+	}
+	if amount < 0 && (kind == catIncome || kind == catExpense) {
+		amount = -amount
+	}
+	if kind == catExpense {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// categoryHousehold returns the household of a category, or 0 if there is
+// no such category.
+func categoryHousehold(id int) int {
+	var hid int
+	db.QueryRow("SELECT IFNULL(household_id, 0) FROM categories WHERE id=?", id).Scan(&hid)
+	return hid
+}
+
+// checkCategory verifies inside tx that a flow of wid may use categoryID.
+// Zero means no category and is always allowed.
+func checkCategory(tx *sql.Tx, wid, categoryID int) error {
+	if categoryID == 0 {
+		return nil
+	}
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM categories c JOIN wallets w ON c.household_id=w.household_id WHERE c.id=? AND w.id=?", categoryID, wid).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return errCategory
+	}
+	return nil
+}
+
+// householdCategories returns the categories of hid in tree order.
+func householdCategories(hid int) ([]*Category, error) {
+	rows, err := db.Query("SELECT id, name, IFNULL(parent_id, 0), kind FROM categories WHERE household_id=? ORDER BY name", hid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*Category{}
+	for rows.Next() {
+		c := &Category{}
+		if err := rows.Scan(&c.ID, &c.Name, &c.ParentID, &c.Kind); err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sortCategories(list), nil
+}
+
+// sortCategories orders categories depth first, each followed by its
+// subcategories, keeping the order of siblings, and sets Depth and Path.
+func sortCategories(list []*Category) []*Category {
+	byID := map[int]*Category{}
+	for _, c := range list {
+		byID[c.ID] = c
+	}
+	children := map[int][]*Category{}
+	for _, c := range list {
+		parent := c.ParentID
+		if byID[parent] == nil {
+			parent = 0
+		}
+		children[parent] = append(children[parent], c)
+	}
+	sorted := make([]*Category, 0, len(list))
+	var walk func(parent int, depth int, path string)
+	walk = func(parent int, depth int, path string) {
+		for _, c := range children[parent] {
+			c.Depth = depth
+			c.Path = path + c.Name
+			sorted = append(sorted, c)
+			walk(c.ID, depth+1, c.Path+" / ")
+		}
+	}
+	walk(0, 0, "")
+	return sorted
+}
+
+// withAncestors returns id followed by the ids of the categories above it.
+func withAncestors(id int, byID map[int]*Category) []int {
+	ids := []int{id}
+	for c := byID[id]; c != nil && c.ParentID != 0 && len(ids) <= len(byID); c = byID[c.ParentID] {
+		ids = append(ids, c.ParentID)
+	}
+	return ids
+}
+
+// rollUp returns totals with the total of every category added to each of
+// its ancestors.
+func rollUp(totals map[int]int64, byID map[int]*Category) map[int]int64 {
+	rolled := map[int]int64{}
+	for id, v := range totals {
+		for _, cid := range withAncestors(id, byID) {
+			rolled[cid] += v
+		}
+	}
+	return rolled
+}
+
+// CategoryRow is a line of a category report. Total includes the
+// subcategories; rows of subcategories follow their parent, and Parent
+// marks rows that have some.
+type CategoryRow struct {
+	*Category
+	Total  int64
+	Parent bool
+}
+
+// categoryRows lists the categories of tree, in tree order, that have an
+// entry in the rolled up totals. Flows without a category come last as a
+// row with ID 0.
+func categoryRows(tree []*Category, rolled map[int]int64) []*CategoryRow {
+	rows := []*CategoryRow{}
+	for _, c := range tree {
+		if v, ok := rolled[c.ID]; ok {
+			if c.ParentID != 0 && len(rows) > 0 {
+				for i := len(rows) - 1; i >= 0; i-- {
+					if rows[i].ID == c.ParentID {
+						rows[i].Parent = true
+						break
+					}
+				}
+			}
+			rows = append(rows, &CategoryRow{Category: c, Total: v})
+		}
+	}
+	if v, ok := rolled[0]; ok {
+		rows = append(rows, &CategoryRow{Category: &Category{}, Total: v})
+	}
+	return rows
+}
+
+// ReportSection is one part of a category report. Total adds up its
+// top-level rows.
+type ReportSection struct {
+	Key   string
+	Rows  []*CategoryRow
+	Total int64
+}
+
+// CategoryReport splits category rows into income, expenses and the other
+// kinds. Net is income less expenses.
+type CategoryReport struct {
+	Sections []*ReportSection
+	Net      int64
+}
+
+func categoryReport(rows []*CategoryRow) *CategoryReport {
+	income := &ReportSection{Key: "Income"}
+	expense := &ReportSection{Key: "Expenses"}
+	other := &ReportSection{Key: "OtherFlows"}
+	for _, row := range rows {
+		s := other
+		switch row.Kind {
+		case catIncome:
+			s = income
+		case catExpense:
+			s = expense
+		}
+		s.Rows = append(s.Rows, row)
+		if row.Depth == 0 {
+			s.Total += row.Total
+		}
+	}
+	report := &CategoryReport{Net: income.Total + expense.Total}
+	for _, s := range []*ReportSection{income, expense, other} {
+		if len(s.Rows) > 0 {
+			report.Sections = append(report.Sections, s)
+		}
+	}
+	return report
+}
+
+// createCategory adds a category named name to hid under parent, or at
+// the top level if parent is 0. Subcategories take the kind of their
+// parent, so kind must be empty or match it; at the top level an empty
+// kind means expense.
+func createCategory(uid, hid, parent int, name, kind string) error {
+	if hid == 0 || !isMember(uid, hid) {
+		return errNotMember
+	}
+	if name == "" || kind != "" && !validKind(kind) || parent != 0 && categoryHousehold(parent) != hid {
+		return errCategory
+	}
+	return categoryTx(func(tx *sql.Tx) error {
+		parents, err := lockCategoryTree(tx, hid)
+		if err != nil {
+			return err
+		}
+		var pid interface{}
+		if parent != 0 {
+			if _, ok := parents[parent]; !ok {
+				return errCategory
+			}
+			var parentKind string
+			if err := tx.QueryRow("SELECT kind FROM categories WHERE id=?", parent).Scan(&parentKind); err != nil {
+				return err
+			}
+			if kind != "" && kind != parentKind {
+				return errCatKind
+			}
+			pid, kind = parent, parentKind
+		} else if kind == "" {
+			kind = catExpense
+		}
+		_, err = tx.Exec("INSERT INTO categories (name, household_id, parent_id, kind) VALUES (?, ?, ?, ?)", name, hid, pid, kind)
+		return err
+	})
+}
+
+// updateCategory renames category id and, in the same transaction, moves
+// it with its subtree under parent and changes its kind. A parent of 0 moves
+// it to the top level and -1 leaves it in place; an empty kind keeps the
+// kind. Under a parent the subtree takes the parent's kind, and only
+// top-level categories may be given another one. The new parent must
+// belong to the same household and may not lie inside the subtree.
+func updateCategory(uid, id int, name, kind string, parent int) error {
+	hid := categoryHousehold(id)
+	if hid == 0 || !isMember(uid, hid) || name == "" {
+		return errCategory
+	}
+	if kind != "" && !validKind(kind) || parent > 0 && categoryHousehold(parent) != hid {
+		return errCategory
+	}
+	return categoryTx(func(tx *sql.Tx) error {
+		parents, err := lockCategoryTree(tx, hid)
+		if err != nil {
+			return err
+		}
+		if parent < 0 {
+			if kind != "" && parents[id] != 0 {
+				return errCatKind
+			}
+			parent = parents[id]
+		} else if err := moveCategory(tx, parents, id, parent); err != nil {
+			return err
+		}
+		if parent != 0 {
+			if err := tx.QueryRow("SELECT kind FROM categories WHERE id=?", parent).Scan(&kind); err != nil {
+				return err
+			}
+		}
+		if kind != "" {
+			if err := setSubtreeKind(tx, parents, id, kind); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec("UPDATE categories SET name=? WHERE id=?", name, id)
+		return err
+	})
+}
+
+// moveCategory puts category id under parent, or at the top level if parent
+// is 0, refusing to move it into its own subtree.
+func moveCategory(tx *sql.Tx, parents map[int]int, id, parent int) error {
+	for p, steps := parent, 0; p != 0 && steps <= len(parents); p, steps = parents[p], steps+1 {
+		if p == id {
+			return errCatCycle
+		}
+	}
+	var pid interface{}
+	if parent != 0 {
+		pid = parent
+	}
+	_, err := tx.Exec("UPDATE categories SET parent_id=? WHERE id=?", pid, id)
+	return err
+}
+
+// categoryTx runs fn in a transaction, reporting a clash of sibling names
+// as errCatExists.
+func categoryTx(fn func(tx *sql.Tx) error) error {
+	err := withTx(fn)
+	if isDuplicate(err) {
+		return errCatExists
+	}
+	return err
+}
+
+// lockCategoryTree locks the categories of hid and returns the parent of
+// each, 0 for top-level ones.
+func lockCategoryTree(tx *sql.Tx, hid int) (map[int]int, error) {
+	rows, err := tx.Query("SELECT id, IFNULL(parent_id, 0) FROM categories WHERE household_id=? FOR UPDATE", hid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	parents := map[int]int{}
+	for rows.Next() {
+		var cid, pid int
+		if err := rows.Scan(&cid, &pid); err != nil {
+			return nil, err
+		}
+		parents[cid] = pid
+	}
+	return parents, rows.Err()
+}
+
+// subtree returns id and the ids of all categories below it.
+func subtree(parents map[int]int, id int) []int {
+	ids := []int{id}
+	seen := map[int]bool{id: true}
+	for i := 0; i < len(ids); i++ {
+		for cid, pid := range parents {
+			if pid == ids[i] && !seen[cid] {
+				seen[cid] = true
+				ids = append(ids, cid)
+			}
+		}
+	}
+	return ids
+}
+
+// setSubtreeKind gives category id and its subcategories kind. It fails
+// with errCatFlows if any of them whose kind would change has flows.
+func setSubtreeKind(tx *sql.Tx, parents map[int]int, id int, kind string) error {
+	ids := subtree(parents, id)
+	for _, cid := range ids {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM flows f JOIN categories c ON f.category_id=c.id WHERE c.id=? AND c.kind<>?", cid, kind).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return errCatFlows
+		}
+	}
+	for _, cid := range ids {
+		if _, err := tx.Exec("UPDATE categories SET kind=? WHERE id=?", kind, cid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WalletUsage is a wallet with the number of flows it has in a category.
+type WalletUsage struct {
+	Name  string
+	Flows int
+}
+
+// categoryUsage lists the wallets with flows in category id.
+func categoryUsage(id int) ([]*WalletUsage, int, error) {
+	rows, err := db.Query("SELECT w.name, COUNT(*) FROM flows f JOIN wallets w ON f.wallet_id=w.id WHERE f.category_id=? GROUP BY w.id, w.name ORDER BY w.name", id)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	list := []*WalletUsage{}
+	total := 0
+	for rows.Next() {
+		u := &WalletUsage{}
+		if err := rows.Scan(&u.Name, &u.Flows); err != nil {
+			return nil, 0, err
+		}
+		total += u.Flows
+		list = append(list, u)
+	}
+	return list, total, rows.Err()
+}
+
+// removeCategory deletes category id in one transaction. Its flows and
+// budgets are reassigned to target, a category of the same household and
+// kind, which may only be 0 if there are no flows; the budgets are then
+// deleted. When merge is set the subcategories of id move under target,
+// otherwise up to the parent of id.
+func removeCategory(uid, id, target int, merge bool) error {
+	hid := categoryHousehold(id)
+	if hid == 0 || !isMember(uid, hid) {
+		return errCategory
+	}
+	if target == id || target != 0 && categoryHousehold(target) != hid || merge && target == 0 {
+		return errCategory
+	}
+	return categoryTx(func(tx *sql.Tx) error {
+		parents, err := lockCategoryTree(tx, hid)
+		if err != nil {
+			return err
+		}
+		if target != 0 {
+			var kind, targetKind string
+			if err := tx.QueryRow("SELECT kind FROM categories WHERE id=?", id).Scan(&kind); err != nil {
+				return err
+			}
+			if err := tx.QueryRow("SELECT kind FROM categories WHERE id=?", target).Scan(&targetKind); err != nil {
+				return err
+			}
+			if kind != targetKind {
+				return errCatKindMix
+			}
+			if _, err := tx.Exec("UPDATE flows SET category_id=? WHERE category_id=?", target, id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("UPDATE budgets SET category_id=? WHERE category_id=?", target, id); err != nil {
+				return err
+			}
+		} else {
+			var count int
+			if err := tx.QueryRow("SELECT COUNT(*) FROM flows WHERE category_id=?", id).Scan(&count); err != nil {
+				return err
+			}
+			if count > 0 {
+				return errCatInUse
+			}
+			if _, err := tx.Exec("DELETE bw FROM budget_wallets bw JOIN budgets b ON bw.budget_id=b.id WHERE b.category_id=?", id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("DELETE FROM budgets WHERE category_id=?", id); err != nil {
+				return err
+			}
+		}
+		var parent interface{}
+		if p := parents[id]; p != 0 {
+			parent = p
+		}
+		if merge {
+			for _, cid := range subtree(parents, id) {
+				if cid == target {
+					return errCatCycle
+				}
+			}
+			parent = target
+		}
+		if _, err := tx.Exec("UPDATE categories SET parent_id=? WHERE parent_id=?", parent, id); err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM categories WHERE id=?", id)
+		return err
+	})
+}
+
+// deleteCategoryHandler shows which flows and wallets a deletion affects
+// and, once confirmed, deletes the category or merges it into another.
+func deleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	uid := currentUser(r)
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	hid := categoryHousehold(id)
+	if hid == 0 || !isMember(uid, hid) {
+		http.Redirect(w, r, "/famoney/dashboard?err="+errCategory.Error(), http.StatusSeeOther)
+		return
+	}
+	data := map[string]interface{}{}
+	if r.Method == "POST" {
+		target, _ := strconv.Atoi(r.FormValue("target"))
+		err := removeCategory(uid, id, target, r.FormValue("action") == "merge")
+		if err == nil {
+			http.Redirect(w, r, "/famoney/dashboard", http.StatusSeeOther)
+			return
+		}
+		data["Error"] = errorKey(err)
+	}
+	tree, err := householdCategories(hid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var category *Category
+	subcategories := 0
+	for _, c := range tree {
+		if c.ID == id {
+			category = c
+		}
+		if c.ParentID == id {
+			subcategories++
+		}
+	}
+	targets := []*Category{}
+	for _, c := range tree {
+		if c.ID != id && c.Kind == category.Kind {
+			targets = append(targets, c)
+		}
+	}
+	wallets, flows, err := categoryUsage(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data["Category"] = category
+	data["Subcategories"] = subcategories
+	data["Wallets"] = wallets
+	data["Flows"] = flows
+	data["Targets"] = targets
+	data["KindKeys"] = categoryKindKeys
+	render(w, r, "category_delete.html", data)
+}
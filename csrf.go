@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+	"regexp"
+)
+
+// Every session carries a random CSRF token kept on the server. render()
+// adds it as a hidden field to each POST form of an authenticated page and
+// exposes it in a meta tag for fetch() calls, which send it back in the
+// X-CSRF-Token header. auth rejects state-changing requests without it.
+// The login and register forms run before a session exists and are not
+// covered.
+
+const (
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+var postFormTag = regexp.MustCompile(`(?i)<form\b[^>]*\bmethod=["']?post["']?[^>]*>`)
+
+// validCSRF reports whether a request may change state for session s.
+func validCSRF(r *http.Request, s *Session) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.FormValue(csrfField)
+	}
+	return s.CSRFToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRFToken)) == 1
+}
+
+// injectCSRF inserts the hidden token field after every POST form tag.
+func injectCSRF(page []byte, token string) []byte {
+	field := []byte(`<input type="hidden" name="` + csrfField + `" value="` + template.HTMLEscapeString(token) + `">`)
+	return postFormTag.ReplaceAllFunc(page, func(tag []byte) []byte {
+		return append(append([]byte{}, tag...), field...)
+	})
+}
+
+// writePage sends a rendered page, adding CSRF fields when the request
+// belongs to a session.
+func writePage(w http.ResponseWriter, r *http.Request, page *bytes.Buffer) {
+	out := page.Bytes()
+	if s := requestSession(r); s != nil && s.CSRFToken != "" {
+		out = injectCSRF(out, s.CSRFToken)
+	}
+	w.Write(out)
+}
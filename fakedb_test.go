@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// fakeDB stands in for MySQL so that tests run offline. A test registers
+// the statements the code under test is expected to run, by their exact
+// text, and answers them from its own state; any other statement fails the
+// test. Transactions are accepted but not isolated.
+type fakeDB struct {
+	t        *testing.T
+	mu       sync.Mutex
+	handlers map[string]fakeHandler
+}
+
+// fakeHandler answers one statement with the rows of a query, or with the
+// number of rows affected by an update.
+type fakeHandler func(args []driver.Value) (*fakeRows, int64)
+
+// useFakeDB points db at a new fakeDB until the test ends.
+func useFakeDB(t *testing.T) *fakeDB {
+	t.Helper()
+	f := &fakeDB{t: t, handlers: map[string]fakeHandler{}}
+	saved := db
+	db = sql.OpenDB(f)
+	t.Cleanup(func() {
+		db.Close()
+		db = saved
+	})
+	return f
+}
+
+func (f *fakeDB) handle(query string, h fakeHandler) {
+	f.mu.Lock()
+	f.handlers[query] = h
+	f.mu.Unlock()
+}
+
+func (f *fakeDB) run(query string, args []driver.Value) (*fakeRows, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, ok := f.handlers[query]
+	if !ok {
+		f.t.Errorf("unexpected statement: %s", query)
+		return nil, 0, fmt.Errorf("unexpected statement: %s", query)
+	}
+	rows, n := h(args)
+	if rows == nil {
+		rows = &fakeRows{}
+	}
+	return rows, n, nil
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return fakeDriver{f} }
+
+type fakeDriver struct{ f *fakeDB }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{d.f}, nil }
+
+type fakeConn struct{ f *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.f, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	f     *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	_, n, err := s.f.run(s.query, args)
+	return driver.RowsAffected(n), err
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, _, err := s.f.run(s.query, args)
+	return rows, err
+}
+
+// fakeRows is the result of a query. All rows have the same number of
+// columns.
+type fakeRows struct {
+	rows [][]driver.Value
+	pos  int
+}
+
+func rowsOf(rows ...[]driver.Value) *fakeRows { return &fakeRows{rows: rows} }
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.pos])
+	r.pos++
+	return nil
+}
+
+// argInt reads an integer statement argument.
+func argInt(v driver.Value) int {
+	n, _ := v.(int64)
+	return int(n)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A household is the set of users who keep their money together. Wallets
+// and categories belong to exactly one household, and a wallet can only be
+// shared with members of its household. A user may belong to several
+// households and picks the one to work in with the switcher in the
+// navigation bar; the choice is kept in the "household" cookie.
+//
+// Members invite other users by username, and an invited user only joins
+// after accepting on their households page. Whether the username exists is
+// not revealed to the inviter.
+
+const householdCookie = "household"
+
+var (
+	errNotMember  = errors.New("ErrNotMember")
+	errLastMember = errors.New("ErrLastMember")
+	errLastOwner  = errors.New("ErrLastOwner")
+)
+
+// Household is a household as listed in the switcher and on the
+// households page.
+type Household struct {
+	ID      int
+	Name    string
+	Members []string
+}
+
+// HouseholdInvite is an invitation waiting for the invitee's answer.
+type HouseholdInvite struct {
+	HouseholdID   int
+	HouseholdName string
+	InvitedBy     string
+	CreatedAt     time.Time
+}
+
+func isMember(uid, hid int) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM household_members WHERE household_id=? AND user_id=?", hid, uid).Scan(&count)
+	return count > 0
+}
+
+// userHouseholds returns the households of uid in the order they were
+// joined.
+func userHouseholds(uid int) ([]*Household, error) {
+	rows, err := db.Query("SELECT h.id, h.name FROM households h JOIN household_members m ON h.id=m.household_id WHERE m.user_id=? ORDER BY m.joined_at, h.id", uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*Household{}
+	for rows.Next() {
+		h := &Household{}
+		if err := rows.Scan(&h.ID, &h.Name); err != nil {
+			return nil, err
+		}
+		list = append(list, h)
+	}
+	return list, rows.Err()
+}
+
+// householdMembers returns the usernames of the active members of hid.
+func householdMembers(hid int) ([]string, error) {
+	rows, err := db.Query("SELECT u.username FROM users u JOIN household_members m ON u.id=m.user_id WHERE m.household_id=? AND u.status=? ORDER BY u.username", hid, userActive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// userInvites returns the household invitations waiting for uid.
+func userInvites(uid int) ([]*HouseholdInvite, error) {
+	rows, err := db.Query("SELECT h.id, h.name, IFNULL(u.username, ''), i.created_at FROM household_invites i JOIN households h ON i.household_id=h.id LEFT JOIN users u ON i.invited_by=u.id WHERE i.user_id=? ORDER BY i.created_at", uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*HouseholdInvite{}
+	for rows.Next() {
+		i := &HouseholdInvite{}
+		if err := rows.Scan(&i.HouseholdID, &i.HouseholdName, &i.InvitedBy, &i.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, i)
+	}
+	return list, rows.Err()
+}
+
+// memberID returns the id of the active member of hid called username, or 0.
+func memberID(hid int, username string) int {
+	var id int
+	db.QueryRow("SELECT u.id FROM users u JOIN household_members m ON u.id=m.user_id WHERE m.household_id=? AND u.username=? AND u.status=?", hid, username, userActive).Scan(&id)
+	return id
+}
+
+func joinHousehold(tx *sql.Tx, hid, uid int) error {
+	_, err := tx.Exec("INSERT IGNORE INTO household_members (household_id, user_id, joined_at) VALUES (?, ?, ?)", hid, uid, time.Now())
+	return err
+}
+
+// createHousehold starts a household with uid as its only member and the
+// default categories in lang.
+func createHousehold(uid int, name, lang string) (int, error) {
+	var hid int
+	err := withTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec("INSERT INTO households (name, created_at) VALUES (?, ?)", name, time.Now())
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		hid = int(id)
+		if err := seedCategories(tx, hid, lang); err != nil {
+			return err
+		}
+		return joinHousehold(tx, hid, uid)
+	})
+	return hid, err
+}
+
+// inviteMember lets a member of hid invite another user to it. Unknown,
+// inactive and existing members are skipped without an error, so the
+// result is the same whether or not the username exists.
+func inviteMember(uid, hid int, username string) error {
+	if !isMember(uid, hid) {
+		return errNotMember
+	}
+	_, err := db.Exec("INSERT IGNORE INTO household_invites (household_id, user_id, invited_by, created_at) SELECT ?, u.id, ?, ? FROM users u WHERE u.username=? AND u.status=? AND NOT EXISTS (SELECT 1 FROM household_members m WHERE m.household_id=? AND m.user_id=u.id)", hid, uid, time.Now(), username, userActive, hid)
+	return err
+}
+
+// answerInvite accepts or declines an invitation of uid to hid.
+func answerInvite(uid, hid int, accept bool) error {
+	return withTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec("DELETE FROM household_invites WHERE household_id=? AND user_id=?", hid, uid)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errNotMember
+		}
+		if !accept {
+			return nil
+		}
+		return joinHousehold(tx, hid, uid)
+	})
+}
+
+// leaveHousehold removes uid from hid together with their access to its
+// wallets. The last member cannot leave, and neither can the only owner of
+// a wallet.
+func leaveHousehold(uid, hid int) error {
+	return withTx(func(tx *sql.Tx) error {
+		var members int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM household_members WHERE household_id=? FOR UPDATE", hid).Scan(&members); err != nil {
+			return err
+		}
+		if members <= 1 {
+			return errLastMember
+		}
+		var sole int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM wallets w JOIN wallet_owners o ON w.id=o.wallet_id WHERE w.household_id=? AND o.user_id=? AND o.role=? AND NOT EXISTS (SELECT 1 FROM wallet_owners o2 WHERE o2.wallet_id=w.id AND o2.user_id<>o.user_id AND o2.role=?)", hid, uid, roleOwner, roleOwner).Scan(&sole); err != nil {
+			return err
+		}
+		if sole > 0 {
+			return errLastOwner
+		}
+		if _, err := tx.Exec("DELETE o FROM wallet_owners o JOIN wallets w ON o.wallet_id=w.id WHERE w.household_id=? AND o.user_id=?", hid, uid); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM household_members WHERE household_id=? AND user_id=?", hid, uid)
+		return err
+	})
+}
+
+// walletHousehold returns the household of a wallet.
+func walletHousehold(wid int) int {
+	var hid int
+	db.QueryRow("SELECT IFNULL(household_id, 0) FROM wallets WHERE id=?", wid).Scan(&hid)
+	return hid
+}
+
+// currentHousehold returns the household the user is working in. It can be
+// changed with ?household=<id>; a user without any household gets a
+// personal one named after them.
+func currentHousehold(w http.ResponseWriter, r *http.Request) int {
+	uid := currentUser(r)
+	if uid == 0 {
+		return 0
+	}
+	if v := r.URL.Query().Get(householdCookie); v != "" {
+		if hid, _ := strconv.Atoi(v); isMember(uid, hid) {
+			http.SetCookie(w, &http.Cookie{Name: householdCookie, Value: v, Path: "/"})
+			return hid
+		}
+	}
+	if c, err := r.Cookie(householdCookie); err == nil {
+		if hid, _ := strconv.Atoi(c.Value); isMember(uid, hid) {
+			return hid
+		}
+	}
+	var hid int
+	err := db.QueryRow("SELECT household_id FROM household_members WHERE user_id=? ORDER BY joined_at, household_id LIMIT 1", uid).Scan(&hid)
+	if err == sql.ErrNoRows {
+		var username string
+		db.QueryRow("SELECT username FROM users WHERE id=?", uid).Scan(&username)
+		hid, err = createHousehold(uid, username, getLang(w, r))
+	}
+	if err != nil {
+		return 0
+	}
+	return hid
+}
+
+func householdsHandler(w http.ResponseWriter, r *http.Request) {
+	uid := currentUser(r)
+	data := map[string]interface{}{}
+	if r.Method == "POST" {
+		hid, _ := strconv.Atoi(r.FormValue("id"))
+		name := strings.TrimSpace(r.FormValue("name"))
+		var err error
+		switch r.FormValue("action") {
+		case "create":
+			if name != "" {
+				_, err = createHousehold(uid, name, getLang(w, r))
+			}
+		case "rename":
+			if !isMember(uid, hid) {
+				err = errNotMember
+			} else if name != "" {
+				_, err = db.Exec("UPDATE households SET name=? WHERE id=?", name, hid)
+			}
+		case "invite":
+			if err = inviteMember(uid, hid, strings.TrimSpace(r.FormValue("username"))); err == nil {
+				http.Redirect(w, r, "/famoney/households?invited=1", http.StatusSeeOther)
+				return
+			}
+		case "accept", "decline":
+			err = answerInvite(uid, hid, r.FormValue("action") == "accept")
+		case "leave":
+			err = leaveHousehold(uid, hid)
+		}
+		if err != nil {
+			http.Redirect(w, r, "/famoney/households?err="+errorKey(err), http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/famoney/households", http.StatusSeeOther)
+		return
+	}
+	current := currentHousehold(w, r)
+	list, err := userHouseholds(uid)
+	if err == nil {
+		for _, h := range list {
+			if h.Members, err = householdMembers(h.ID); err != nil {
+				break
+			}
+		}
+	}
+	var invites []*HouseholdInvite
+	if err == nil {
+		invites, err = userInvites(uid)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data["Households"] = list
+	data["Household"] = current
+	data["Invitations"] = invites
+	data["Invited"] = r.URL.Query().Get("invited") != ""
+	if errKey := r.URL.Query().Get("err"); errKey != "" {
+		if _, ok := translations["en"][errKey]; ok {
+			data["Error"] = errKey
+		}
+	}
+	render(w, r, "households.html", data)
+}
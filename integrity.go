@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// wallet_balances is a running total kept next to the flow history. The
+// integrity check recomputes every balance from SUM(flows.amount) and
+// reports the rows that disagree.
+
+// Repair modes for a balance discrepancy: rebuild trusts the flows and
+// overwrites the cached balance, correct trusts the balance and books a
+// correction flow for the difference.
+const (
+	repairRebuild = "rebuild"
+	repairCorrect = "correct"
+)
+
+const correctionNote = "Balance correction"
+
+var errRepairMode = errors.New("ErrRepairMode")
+
+// BalanceIssue is one wallet/currency whose cached balance differs from
+// the sum of its flows.
+type BalanceIssue struct {
+	WalletID   int
+	WalletName string
+	Currency   string
+	Cached     int64
+	Computed   int64
+}
+
+// Diff is the amount by which the cached balance exceeds the flows.
+func (i *BalanceIssue) Diff() int64 {
+	return i.Cached - i.Computed
+}
+
+// checkBalances compares every wallet_balances row with the flows of the
+// same wallet and currency. Currencies that only appear on one side are
+// treated as zero on the other.
+func checkBalances() ([]*BalanceIssue, error) {
+	rows, err := db.Query(`SELECT w.id, w.name, k.currency, IFNULL(b.balance, 0), IFNULL(f.total, 0)
+		FROM (SELECT wallet_id, currency FROM wallet_balances UNION SELECT wallet_id, currency FROM flows) k
+		JOIN wallets w ON w.id=k.wallet_id
+		LEFT JOIN wallet_balances b ON b.wallet_id=k.wallet_id AND b.currency=k.currency
+		LEFT JOIN (SELECT wallet_id, currency, SUM(amount) AS total FROM flows GROUP BY wallet_id, currency) f ON f.wallet_id=k.wallet_id AND f.currency=k.currency
+		WHERE IFNULL(b.balance, 0) <> IFNULL(f.total, 0)
+		ORDER BY w.id, k.currency`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	issues := []*BalanceIssue{}
+	for rows.Next() {
+		i := &BalanceIssue{}
+		if err := rows.Scan(&i.WalletID, &i.WalletName, &i.Currency, &i.Cached, &i.Computed); err != nil {
+			return nil, err
+		}
+		issues = append(issues, i)
+	}
+	return issues, rows.Err()
+}
+
+// repairBalance resolves the discrepancy of one wallet and currency. The
+// balance row is locked and the flows are summed again inside the
+// transaction, so a repair never acts on a stale report. Correction flows
+// are booked under uid.
+func repairBalance(uid, wid int, cur, mode string) error {
+	if mode != repairRebuild && mode != repairCorrect {
+		return errRepairMode
+	}
+	return withTx(func(tx *sql.Tx) error {
+		key := balanceKey{wid, cur}
+		balances, err := lockBalances(tx, key)
+		if err != nil {
+			return err
+		}
+		var computed int64
+		if err := tx.QueryRow("SELECT IFNULL(SUM(amount), 0) FROM flows WHERE wallet_id=? AND currency=?", wid, cur).Scan(&computed); err != nil {
+			return err
+		}
+		diff := balances[key] - computed
+		if diff == 0 {
+			return nil
+		}
+		if mode == repairRebuild {
+			_, err := tx.Exec("UPDATE wallet_balances SET balance=? WHERE wallet_id=? AND currency=?", computed, wid, cur)
+			return err
+		}
+		_, err = insertFlow(tx, wid, diff, cur, 0, correctionNote, time.Now(), uid, flowNormal)
+		return err
+	})
+}
+
+// runCheck implements the "check" subcommand. It prints every discrepancy
+// and, with -repair, fixes them. The exit status is non-zero while
+// discrepancies remain.
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := fs.String("repair", "", "repair discrepancies: rebuild (trust flows) or correct (book a correction flow)")
+	user := fs.String("user", "", "username that correction flows are booked under")
+	fs.Parse(args)
+
+	var uid int
+	switch *repair {
+	case "", repairRebuild:
+	case repairCorrect:
+		if err := db.QueryRow("SELECT id FROM users WHERE username=?", *user).Scan(&uid); err != nil {
+			return fmt.Errorf("-repair=correct needs an existing -user: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown repair mode %q", *repair)
+	}
+
+	issues, err := checkBalances()
+	if err != nil {
+		return err
+	}
+	if len(issues) == 0 {
+		fmt.Println("all balances match their flows")
+		return nil
+	}
+	failed := 0
+	for _, i := range issues {
+		fmt.Printf("wallet %d (%s) %s: balance %s, flows %s, difference %s\n", i.WalletID, i.WalletName, i.Currency,
+			moneyString(i.Cached, i.Currency), moneyString(i.Computed, i.Currency), moneyString(i.Diff(), i.Currency))
+		if *repair == "" {
+			failed++
+			continue
+		}
+		if err := repairBalance(uid, i.WalletID, i.Currency, *repair); err != nil {
+			fmt.Println("  repair failed:", err)
+			failed++
+			continue
+		}
+		fmt.Println("  repaired:", *repair)
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d balances need attention\n", failed, len(issues))
+		os.Exit(1)
+	}
+	return nil
+}
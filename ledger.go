@@ -0,0 +1,507 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Flow kinds. Normal flows are income and expenses booked against a
+// category; transfer flows come in linked pairs and only move money
+// between wallets; exchange flows are linked pairs converting one
+// currency into another inside a wallet.
+const (
+	flowNormal   = "normal"
+	flowTransfer = "transfer"
+	flowExchange = "exchange"
+)
+
+// Ledger errors double as translation keys so handlers can show them as-is.
+var (
+	errInvalidAmount = errors.New("ErrAmount")
+	errSameWallet    = errors.New("ErrSameWallet")
+	errNotOwner      = errors.New("ErrNotOwner")
+	errSameCurrency  = errors.New("ErrSameCurrency")
+	errLedger        = errors.New("ErrLedger")
+)
+
+// errorKey returns the translation key for a ledger error, hiding
+// unexpected database errors behind a generic message.
+func errorKey(err error) string {
+	switch err {
+	case errInvalidAmount, errSameWallet, errNotOwner, errSameCurrency,
+		errPassword, errPwMismatch, errPwShort, errPwLong, errUsername,
+		errTOTPCode, errTOTPActive, errRegClosed, errInvite, errInviteNeed,
+		errNotMember, errLastMember, errLastOwner, errRole,
+		errSelf, errDisabled, errCategory, errCatCycle, errCatKind, errCatKindMix, errCatInUse,
+		errCatExists, errCatFlows, errBalanceCat, errBudget, errCurrency, errRepairMode:
+		return err.Error()
+	case errMoneyFormat:
+		return errInvalidAmount.Error()
+	}
+	log.Println("ledger:", err)
+	return errLedger.Error()
+}
+
+// ownsWallet reports whether wid is shared with uid in any role.
+func ownsWallet(uid, wid int) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM wallet_owners WHERE wallet_id=? AND user_id=?", wid, uid).Scan(&count)
+	return count > 0
+}
+
+// isDuplicate reports whether err is MySQL's duplicate key error.
+func isDuplicate(err error) bool {
+	var me *mysql.MySQLError
+	return errors.As(err, &me) && me.Number == 1062
+}
+
+// withTx runs fn inside a transaction, committing if it returns nil and
+// rolling back otherwise.
+func withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// balanceKey identifies one wallet_balances row.
+type balanceKey struct {
+	WalletID int
+	Currency string
+}
+
+// lockBalances creates any missing wallet_balances rows and locks them for
+// the rest of the transaction. Rows are always locked in the same order so
+// concurrent transfers between the same wallets cannot deadlock.
+func lockBalances(tx *sql.Tx, keys ...balanceKey) (map[balanceKey]int64, error) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].WalletID != keys[j].WalletID {
+			return keys[i].WalletID < keys[j].WalletID
+		}
+		return keys[i].Currency < keys[j].Currency
+	})
+	balances := map[balanceKey]int64{}
+	for _, k := range keys {
+		if _, ok := balances[k]; ok {
+			continue
+		}
+		if _, err := tx.Exec("INSERT IGNORE INTO wallet_balances (wallet_id, currency, balance) VALUES (?, ?, 0)", k.WalletID, k.Currency); err != nil {
+			return nil, err
+		}
+		var bal int64
+		if err := tx.QueryRow("SELECT balance FROM wallet_balances WHERE wallet_id=? AND currency=? FOR UPDATE", k.WalletID, k.Currency).Scan(&bal); err != nil {
+			return nil, err
+		}
+		balances[k] = bal
+	}
+	return balances, nil
+}
+
+func insertFlow(tx *sql.Tx, wid int, amount int64, cur string, categoryID int, desc string, at time.Time, uid int, kind string) (int64, error) {
+	var cat interface{}
+	if categoryID != 0 {
+		cat = categoryID
+	}
+	res, err := tx.Exec("INSERT INTO flows (wallet_id, amount, currency, category_id, description, created_at, operator_id, kind, usd_rate) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", wid, amount, cur, cat, desc, at, uid, kind, snapshotRate(cur))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func adjustBalance(tx *sql.Tx, wid int, cur string, delta int64) error {
+	_, err := tx.Exec("INSERT INTO wallet_balances (wallet_id, currency, balance) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE balance=balance+VALUES(balance)", wid, cur, delta)
+	return err
+}
+
+func linkFlows(tx *sql.Tx, a, b int64) error {
+	if _, err := tx.Exec("UPDATE flows SET linked_flow_id=? WHERE id=?", b, a); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE flows SET linked_flow_id=? WHERE id=?", a, b)
+	return err
+}
+
+// createWallet adds a wallet of household hid owned by uid, placed after
+// the user's other wallets, with an empty balance in its starting currency.
+func createWallet(uid, hid int, name, color, cur string) error {
+	if !isMember(uid, hid) {
+		return errNotMember
+	}
+	return withTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec("INSERT INTO wallets (name, color, household_id) VALUES (?, ?, ?)", name, color, hid)
+		if err != nil {
+			return err
+		}
+		wid, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		var order int
+		if err := tx.QueryRow("SELECT IFNULL(MAX(display_order), 0) + 1 FROM wallet_owners WHERE user_id=?", uid).Scan(&order); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO wallet_owners (wallet_id, user_id, display_order, role) VALUES (?, ?, ?, ?)", wid, uid, order, roleOwner); err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO wallet_balances (wallet_id, currency, balance) VALUES (?, ?, 0)", wid, cur)
+		return err
+	})
+}
+
+// deleteWallet removes a wallet with its flows, balances and owners. Flows
+// in other wallets that were linked to it keep their amounts but lose the
+// link.
+func deleteWallet(uid, wid int) error {
+	if !hasRole(uid, wid, roleOwner) {
+		return errRole
+	}
+	return withTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT balance FROM wallet_balances WHERE wallet_id=? FOR UPDATE", wid)
+		if err != nil {
+			return err
+		}
+		rows.Close()
+		for _, q := range []string{
+			"UPDATE flows f JOIN flows o ON f.linked_flow_id=o.id SET f.linked_flow_id=NULL WHERE o.wallet_id=?",
+			"DELETE FROM flows WHERE wallet_id=?",
+			"DELETE FROM wallet_balances WHERE wallet_id=?",
+			"DELETE FROM wallet_owners WHERE wallet_id=?",
+			"DELETE FROM budget_wallets WHERE wallet_id=?",
+			"DELETE FROM wallets WHERE id=?",
+		} {
+			if _, err := tx.Exec(q, wid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// addFlow books a single income or expense against a category. The sign of
+// amount follows the kind of the category.
+func addFlow(uid, wid int, amount int64, cur string, categoryID int, desc string) error {
+	if !hasRole(uid, wid, roleContributor) {
+		return errRole
+	}
+	return withTx(func(tx *sql.Tx) error {
+		if err := checkCategory(tx, wid, categoryID); err != nil {
+			return err
+		}
+		amount, err := signedAmount(tx, categoryID, amount)
+		if err != nil {
+			return err
+		}
+		if _, err := lockBalances(tx, balanceKey{wid, cur}); err != nil {
+			return err
+		}
+		if _, err := insertFlow(tx, wid, amount, cur, categoryID, desc, time.Now(), uid, flowNormal); err != nil {
+			return err
+		}
+		return adjustBalance(tx, wid, cur, amount)
+	})
+}
+
+// setBalance sets a wallet's balance in cur to target and records the
+// difference as a flow in the given category. The difference may have
+// either sign, so only categories that keep the sign as typed, or none,
+// are accepted.
+func setBalance(uid, wid int, target int64, cur string, categoryID int, desc string) error {
+	if !hasRole(uid, wid, roleEditor) {
+		return errRole
+	}
+	return withTx(func(tx *sql.Tx) error {
+		if err := checkCategory(tx, wid, categoryID); err != nil {
+			return err
+		}
+		if categoryID != 0 {
+			var kind string
+			if err := tx.QueryRow("SELECT kind FROM categories WHERE id=?", categoryID).Scan(&kind); err != nil {
+				return err
+			}
+			if kind == catIncome || kind == catExpense {
+				return errBalanceCat
+			}
+		}
+		key := balanceKey{wid, cur}
+		balances, err := lockBalances(tx, key)
+		if err != nil {
+			return err
+		}
+		diff := target - balances[key]
+		if _, err := insertFlow(tx, wid, diff, cur, categoryID, desc, time.Now(), uid, flowNormal); err != nil {
+			return err
+		}
+		return adjustBalance(tx, wid, cur, diff)
+	})
+}
+
+// transferFunds debits one wallet and credits another in a single
+// transaction, recording the two sides as linked transfer flows.
+func transferFunds(uid, fromID, toID int, amount int64, cur, desc string) error {
+	if amount <= 0 {
+		return errInvalidAmount
+	}
+	if fromID == toID {
+		return errSameWallet
+	}
+	if !ownsWallet(uid, fromID) || !ownsWallet(uid, toID) {
+		return errNotOwner
+	}
+	if !hasRole(uid, fromID, roleEditor) || !hasRole(uid, toID, roleContributor) {
+		return errRole
+	}
+	return withTx(func(tx *sql.Tx) error {
+		if _, err := lockBalances(tx, balanceKey{fromID, cur}, balanceKey{toID, cur}); err != nil {
+			return err
+		}
+		now := time.Now()
+		out, err := insertFlow(tx, fromID, -amount, cur, 0, desc, now, uid, flowTransfer)
+		if err != nil {
+			return err
+		}
+		in, err := insertFlow(tx, toID, amount, cur, 0, desc, now, uid, flowTransfer)
+		if err != nil {
+			return err
+		}
+		if err := linkFlows(tx, out, in); err != nil {
+			return err
+		}
+		if err := adjustBalance(tx, fromID, cur, -amount); err != nil {
+			return err
+		}
+		return adjustBalance(tx, toID, cur, amount)
+	})
+}
+
+// Exchange describes an executed currency exchange and how it compares to
+// the market rate at the time.
+type Exchange struct {
+	FromAmount   int64
+	FromCurrency string
+	ToAmount     int64
+	ToCurrency   string
+	Rate         float64
+	MarketRate   float64
+	// Gain is the difference between what was received and what the
+	// market rate would have given, in minor units of ToCurrency.
+	Gain int64
+}
+
+// exchangeCurrency converts money inside a wallet at the rate actually
+// executed, booking a linked debit/credit pair and updating both balances
+// in one transaction.
+func exchangeCurrency(uid, wid int, fromAmount int64, fromCur string, toAmount int64, toCur, desc string) (*Exchange, error) {
+	if fromAmount <= 0 || toAmount <= 0 {
+		return nil, errInvalidAmount
+	}
+	if fromCur == toCur {
+		return nil, errSameCurrency
+	}
+	if !hasRole(uid, wid, roleEditor) {
+		return nil, errRole
+	}
+	hid := walletHousehold(wid)
+	ex := &Exchange{
+		FromAmount:   fromAmount,
+		FromCurrency: fromCur,
+		ToAmount:     toAmount,
+		ToCurrency:   toCur,
+		Rate:         toMajor(toAmount, toCur) / toMajor(fromAmount, fromCur),
+		MarketRate:   convert(hid, 1, fromCur, toCur),
+	}
+	ex.Gain = toAmount - convertMoney(hid, fromAmount, fromCur, toCur)
+	err := withTx(func(tx *sql.Tx) error {
+		if _, err := lockBalances(tx, balanceKey{wid, fromCur}, balanceKey{wid, toCur}); err != nil {
+			return err
+		}
+		now := time.Now()
+		out, err := insertFlow(tx, wid, -fromAmount, fromCur, 0, desc, now, uid, flowExchange)
+		if err != nil {
+			return err
+		}
+		in, err := insertFlow(tx, wid, toAmount, toCur, 0, desc, now, uid, flowExchange)
+		if err != nil {
+			return err
+		}
+		if err := linkFlows(tx, out, in); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE flows SET rate=?, market_rate=? WHERE id IN (?, ?)", ex.Rate, ex.MarketRate, out, in); err != nil {
+			return err
+		}
+		if err := adjustBalance(tx, wid, fromCur, -fromAmount); err != nil {
+			return err
+		}
+		return adjustBalance(tx, wid, toCur, toAmount)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ex, nil
+}
+
+// lockFlow reads a flow and, if it is one side of a pair, its counterpart,
+// locking both rows for the rest of the transaction. link is nil for an
+// unpaired flow.
+func lockFlow(tx *sql.Tx, id int) (f, link *Flow, err error) {
+	const q = "SELECT id, wallet_id, amount, currency, kind, created_at, IFNULL(linked_flow_id, 0) FROM flows WHERE id=? FOR UPDATE"
+	var linkID int
+	f = &Flow{}
+	if err := tx.QueryRow(q, id).Scan(&f.ID, &f.WalletID, &f.Amount, &f.Currency, &f.Kind, &f.CreatedAt, &linkID); err != nil {
+		return nil, nil, err
+	}
+	if linkID == 0 {
+		return f, nil, nil
+	}
+	link = &Flow{}
+	var back int
+	if err := tx.QueryRow(q, linkID).Scan(&link.ID, &link.WalletID, &link.Amount, &link.Currency, &link.Kind, &link.CreatedAt, &back); err != nil {
+		if err == sql.ErrNoRows {
+			return f, nil, nil
+		}
+		return nil, nil, err
+	}
+	return f, link, nil
+}
+
+// flowWallet returns the wallet a flow belongs to, or 0 if it does not
+// exist or uid has no access to it.
+func flowWallet(uid, id int) int {
+	var wid int
+	db.QueryRow("SELECT wallet_id FROM flows WHERE id=?", id).Scan(&wid)
+	if wid == 0 || !ownsWallet(uid, wid) {
+		return 0
+	}
+	return wid
+}
+
+// deleteFlow removes a flow, and its linked counterpart if any, reverting
+// the wallet balances they contributed to.
+func deleteFlow(uid, id int) error {
+	return withTx(func(tx *sql.Tx) error {
+		f, link, err := lockFlow(tx, id)
+		if err != nil {
+			return err
+		}
+		if !hasRole(uid, f.WalletID, roleEditor) || link != nil && !hasRole(uid, link.WalletID, roleEditor) {
+			return errRole
+		}
+		keys := []balanceKey{{f.WalletID, f.Currency}}
+		if link != nil {
+			keys = append(keys, balanceKey{link.WalletID, link.Currency})
+		}
+		if _, err := lockBalances(tx, keys...); err != nil {
+			return err
+		}
+		for _, fl := range []*Flow{f, link} {
+			if fl == nil {
+				continue
+			}
+			if err := adjustBalance(tx, fl.WalletID, fl.Currency, -fl.Amount); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("DELETE FROM flows WHERE id=?", fl.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// updateFlow rewrites a flow. For a transfer the counterpart is kept in
+// sync: it mirrors the amount with the opposite sign and shares currency
+// and description. Transfers and exchange legs keep their direction, so
+// the amount only changes the size, and may not be zero. An exchange leg
+// keeps its currency and the executed rate of the pair is recomputed.
+func updateFlow(uid, id int, amount int64, cur string, categoryID int, desc string) error {
+	return withTx(func(tx *sql.Tx) error {
+		f, link, err := lockFlow(tx, id)
+		if err != nil {
+			return err
+		}
+		if !hasRole(uid, f.WalletID, roleEditor) || link != nil && !hasRole(uid, link.WalletID, roleEditor) {
+			return errRole
+		}
+		if f.Kind == flowExchange || f.Kind == flowTransfer {
+			if amount == 0 {
+				return errInvalidAmount
+			}
+			if (amount < 0) != (f.Amount < 0) {
+				amount = -amount
+			}
+		}
+		if f.Kind == flowExchange {
+			cur = f.Currency
+		}
+		if f.Kind != flowNormal {
+			categoryID = 0
+		}
+		if err := checkCategory(tx, f.WalletID, categoryID); err != nil {
+			return err
+		}
+		if amount, err = signedAmount(tx, categoryID, amount); err != nil {
+			return err
+		}
+		keys := []balanceKey{{f.WalletID, f.Currency}, {f.WalletID, cur}}
+		if link != nil && f.Kind == flowTransfer {
+			keys = append(keys, balanceKey{link.WalletID, link.Currency}, balanceKey{link.WalletID, cur})
+		}
+		if _, err := lockBalances(tx, keys...); err != nil {
+			return err
+		}
+		if err := adjustBalance(tx, f.WalletID, f.Currency, -f.Amount); err != nil {
+			return err
+		}
+		if err := adjustBalance(tx, f.WalletID, cur, amount); err != nil {
+			return err
+		}
+		var cat interface{}
+		if categoryID != 0 {
+			cat = categoryID
+		}
+		if _, err := tx.Exec("UPDATE flows SET amount=?, currency=?, category_id=?, description=?, operator_id=? WHERE id=?", amount, cur, cat, desc, uid, f.ID); err != nil {
+			return err
+		}
+		linkID := 0
+		if link != nil {
+			linkID = link.ID
+		}
+		if cur != f.Currency {
+			if _, err := tx.Exec("UPDATE flows SET usd_rate=? WHERE id IN (?, ?)", snapshotRateAt(cur, f.CreatedAt), f.ID, linkID); err != nil {
+				return err
+			}
+		}
+		if link != nil && f.Kind == flowTransfer {
+			if err := adjustBalance(tx, link.WalletID, link.Currency, -link.Amount); err != nil {
+				return err
+			}
+			if err := adjustBalance(tx, link.WalletID, cur, -amount); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("UPDATE flows SET amount=?, currency=?, description=?, operator_id=? WHERE id=?", -amount, cur, desc, uid, link.ID); err != nil {
+				return err
+			}
+		}
+		if link != nil && f.Kind == flowExchange {
+			rate := toMajor(amount, cur) / toMajor(-link.Amount, link.Currency)
+			if amount < 0 {
+				rate = toMajor(link.Amount, link.Currency) / toMajor(-amount, cur)
+			}
+			if _, err := tx.Exec("UPDATE flows SET rate=?, description=? WHERE id IN (?, ?)", rate, desc, f.ID, link.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
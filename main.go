@@ -1,9 +1,8 @@
 package main
 
 import (
-	"crypto/rand"
+	"bytes"
 	"database/sql"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
@@ -15,6 +14,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,83 +23,150 @@ import (
 type User struct {
 	ID       int
 	Username string
-	Password string // In production use hashed passwords
+	Password string // bcrypt hash, see passwords.go
 }
 
 type Wallet struct {
 	ID               int
 	Name             string
 	Color            string
-	Balances         map[string]float64
+	HouseholdID      int
+	Balances         map[string]int64
 	Owners           []int
-	CategoryBalances map[int]float64
+	CategoryBalances map[int]int64
+	TransferBalance  int64
+	ExchangeBalance  int64
 }
 
 type Category struct {
-	ID   int
-	Name string
+	ID       int
+	Name     string
+	ParentID int
+	Kind     string
+	// Depth and Path place the category in its household's tree: Depth is 0
+	// for top-level categories and Path joins the names from the top down.
+	Depth int
+	Path  string
 }
 
 type Flow struct {
 	ID          int
 	WalletID    int
-	Amount      float64
+	Amount      int64
 	Currency    string
 	CategoryID  int
 	Description string
 	CreatedAt   time.Time
 	OperatorID  int
 	Operator    string
+	Kind        string
+	// Counterparty is the name of the wallet on the other side of a transfer.
+	Counterparty string
+	// Rate and MarketRate are set on exchange flows: the executed rate and
+	// the market rate when the exchange was booked.
+	Rate       float64
+	MarketRate float64
+}
+
+// ExchangeGain reports, for the credit side of an exchange, how much more
+// (or less) was received than the market rate would have given.
+func (f *Flow) ExchangeGain() int64 {
+	if f.Kind != flowExchange || f.Amount <= 0 || f.Rate == 0 {
+		return 0
+	}
+	return f.Amount - fromMajor(toMajor(f.Amount, f.Currency)/f.Rate*f.MarketRate, f.Currency)
 }
 
 var db *sql.DB
 
-var currencyRates = map[string]float64{}
+var (
+	ratesMu       sync.RWMutex
+	currencyRates = map[string]float64{"USD": 1}
+	// ratesSource and ratesUpdated describe where the current rates came
+	// from and when they were fetched.
+	ratesSource  string
+	ratesUpdated time.Time
+	// ratesFetched is the last successful fetch by this process and
+	// ratesFetchErr the error of the last attempt if it failed.
+	ratesFetched  time.Time
+	ratesAttempt  time.Time
+	ratesFetchErr string
+)
+
+var rateProviders rateProviderChain
+
+// getRates returns the current rate set. The map is replaced, never
+// modified, so callers may read it without holding the lock.
+func getRates() map[string]float64 {
+	ratesMu.RLock()
+	defer ratesMu.RUnlock()
+	return currencyRates
+}
+
+func setRates(rates map[string]float64, source string, at time.Time) {
+	rates["USD"] = 1
+	ratesMu.Lock()
+	currencyRates = rates
+	ratesSource = source
+	ratesUpdated = at
+	ratesMu.Unlock()
+}
 
 func updateCurrencyRates() {
-	exrate_api := os.Getenv("EXRATE_API")
-	if exrate_api == "" {
-		log.Fatal("EXRATE_API must be set")
+	p, rates, err := rateProviders.fetch()
+	now := time.Now()
+	ratesMu.Lock()
+	ratesAttempt = now
+	if err != nil {
+		ratesFetchErr = err.Error()
+	} else {
+		ratesFetchErr = ""
+		ratesFetched = now
 	}
-	resp, err := http.Get("https://v6.exchangerate-api.com/v6/" + exrate_api + "/latest/USD")
+	ratesMu.Unlock()
 	if err != nil {
 		log.Println("failed to fetch currency rates", err)
 		return
 	}
-	defer resp.Body.Close()
-	var data struct {
-		Rates map[string]float64 `json:"conversion_rates"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		log.Println("failed to decode currency rates", err)
+	setRates(rates, p.Name(), now)
+	storeRates(rates)
+}
+
+// loadStoredRates restores the last known good rates from the database so
+// conversions work before, or without, a successful fetch.
+func loadStoredRates() {
+	rates := ratesOn(time.Now())
+	if len(rates) == 0 {
 		return
 	}
-	currencyRates = map[string]float64{"USD": 1}
-	for k, v := range data.Rates {
-		currencyRates[k] = v
-	}
+	var day time.Time
+	db.QueryRow("SELECT MAX(rate_date) FROM exchange_rates").Scan(&day)
+	setRates(rates, "database", day)
 }
 
 func currencyList() []string {
-	codes := make([]string, 0, len(currencyRates))
-	for k := range currencyRates {
+	rates := getRates()
+	codes := make([]string, 0, len(rates))
+	for k := range rates {
 		codes = append(codes, k)
 	}
 	sort.Strings(codes)
 	return codes
 }
 
-func convert(amount float64, from, to string) float64 {
-	rateFrom, okFrom := currencyRates[from]
-	rateTo, okTo := currencyRates[to]
-	if !okFrom || !okTo {
-		return amount
-	}
-	usd := amount / rateFrom
-	return usd * rateTo
+// knownCurrency reports whether cur is one of the currencies with a rate.
+func knownCurrency(cur string) bool {
+	_, ok := getRates()[cur]
+	return ok
 }
 
-func filterBalances(b map[string]float64, base string) {
+// convert converts at today's rates for household hid; its rate overrides
+// take precedence over the fetched market rates.
+func convert(hid int, amount float64, from, to string) float64 {
+	return convertWith(getRates(), overridesOn(hid, time.Now()), amount, from, to)
+}
+
+func filterBalances(b map[string]int64, base string) {
 	if _, ok := b[base]; !ok {
 		b[base] = 0
 	}
@@ -110,27 +177,6 @@ func filterBalances(b map[string]float64, base string) {
 	}
 }
 
-func formatMoney(amount float64) string {
-	sign := ""
-	if amount < 0 {
-		sign = "-"
-		amount = -amount
-	}
-	s := fmt.Sprintf("%.2f", amount)
-	parts := strings.Split(s, ".")
-	intPart := parts[0]
-	fracPart := parts[1]
-	n := len(intPart)
-	var b strings.Builder
-	for i, r := range intPart {
-		if i != 0 && (n-i)%3 == 0 {
-			b.WriteByte(',')
-		}
-		b.WriteRune(r)
-	}
-	return sign + b.String() + "." + fracPart
-}
-
 var translations = map[string]map[string]string{
 	"en": {
 		"Login":           "Login",
@@ -166,16 +212,243 @@ var translations = map[string]map[string]string{
 		"EditWallet":      "Edit Wallet",
 		"EditCategories":  "Edit Categories",
 		"ViewCategories":  "View Categories",
-		"CategoryInUse":   "Category has money and cannot be deleted",
 		"Summary":         "Summary",
 		"TotalBalance":    "Total Balance",
 		"ByCurrency":      "By Currency",
 		"ByCategory":      "By Category",
 		"Close":           "Close",
-		"AllUsers":        "All Users",
+		"AllUsers":        "Household Members",
 		"SharedUsers":     "Shared Users",
 		"Unshare":         "Cancel Share",
 		"CategoryDetails": "Category Details",
+		"Transfer":        "Transfer",
+		"TargetWallet":    "Target Wallet",
+		"Transfers":       "Transfers",
+		"ErrAmount":       "Invalid amount",
+		"ErrSameWallet":   "Source and target wallet must differ",
+		"ErrNotOwner":     "You do not have access to both wallets",
+		"ErrLedger":       "The operation failed and was not saved",
+		"Exchange":        "Exchange",
+		"Exchanges":       "Exchanges",
+		"From":            "From",
+		"To":              "To",
+		"Rate":            "Rate",
+		"MarketRate":      "Market Rate",
+		"GainLoss":        "Gain/Loss",
+		"ErrSameCurrency": "Source and target currency must differ",
+		"ValuedToday":     "Valued at today's rate",
+		"ValuedAtDate":    "Valued at transaction-date rate",
+		"Rates":           "Exchange Rates",
+		"ManualRates":     "Manual Rates",
+		"RatePerUSD":      "Units per 1 USD",
+		"RatesSource":     "Source",
+		"RatesUpdated":    "Updated",
+		"Save":            "Save",
+		"RateOverrides":   "Rate Overrides",
+		"OverrideHelp":    "1 unit of the first currency equals the given amount of the second. Overrides apply to the current household and win over fetched rates.",
+		"ValidFrom":       "Valid From",
+		"ValidTo":         "Valid To",
+		"Note":            "Note",
+		"Active":          "Active",
+		"ChangePassword":  "Change Password",
+		"CurrentPassword": "Current Password",
+		"NewPassword":     "New Password",
+		"ConfirmPassword": "Confirm Password",
+		"PasswordSaved":   "Password changed",
+		"ErrPassword":     "Current password is incorrect",
+		"ErrPwMismatch":   "Passwords do not match",
+		"ErrPwShort":      "Password must be at least 8 characters",
+		"ErrPwLong":       "Password must be at most 72 bytes",
+		"ErrUsername":     "Username is empty or already taken",
+		"Sessions":        "Sessions",
+		"Device":          "Device",
+		"IPAddress":       "IP Address",
+		"SignedIn":        "Signed In",
+		"LastSeen":        "Last Seen",
+		"ThisDevice":      "This device",
+		"Revoke":          "Revoke",
+		"LogoutAll":       "Log out everywhere",
+		"ErrLogin":        "Invalid username or password",
+		"Account":         "Account",
+		"TwoFactor":       "Two-Factor Authentication",
+		"TOTPCode":        "Authentication code",
+		"TOTPPrompt":      "Enter the 6-digit code from your authenticator app, or one of your recovery codes.",
+		"TOTPScan":        "Scan this QR code with an authenticator app, or enter the key by hand, then confirm with the code it shows.",
+		"TOTPSecret":      "Key",
+		"TOTPOn":          "Two-factor authentication is on.",
+		"TOTPOff":         "Two-factor authentication is off.",
+		"Enable":          "Enable",
+		"Disable":         "Disable",
+		"RecoveryCodes":   "Recovery Codes",
+		"RecoveryHelp":    "Each code can be used once instead of an authentication code. Store them somewhere safe; they are shown only now.",
+		"RecoveryLeft":    "Unused recovery codes",
+		"NewRecovery":     "New Recovery Codes",
+		"ErrTOTPCode":     "Invalid authentication code",
+		"ErrTOTPActive":   "Two-factor authentication is already on",
+		"Passkeys":        "Passkeys",
+		"PasskeyHelp":     "Sign in with your fingerprint, face or device PIN instead of a password. You can add a passkey for each phone or computer you use.",
+		"AddPasskey":      "Add Passkey",
+		"PasskeyName":     "Passkey name",
+		"PasskeyLogin":    "Sign in with a passkey",
+		"PasskeyOff":      "Passkeys are not configured on this server.",
+		"NoPasskeys":      "No passkeys yet",
+		"Created":         "Created",
+		"LastUsed":        "Last Used",
+		"Rename":          "Rename",
+		"ErrPasskey":      "Passkey verification failed",
+		"ErrThrottled":    "Too many failed attempts, please try again in",
+		"Integrity":       "Balance Check",
+		"IntegrityOK":     "All wallet balances match their flows.",
+		"IntegrityHelp":   "Rebuild overwrites the cached balance with the sum of the flows. Correct keeps the balance and books a correction flow for the difference.",
+		"CachedBalance":   "Recorded Balance",
+		"FlowsTotal":      "Sum of Flows",
+		"Difference":      "Difference",
+		"Rebuild":         "Rebuild",
+		"Correct":         "Correct",
+		"RebuildAll":      "Rebuild All",
+		"CorrectAll":      "Correct All",
+		"ErrRepairMode":   "Unknown repair mode",
+		"Registrations":   "Registrations",
+		"RegMode":         "Registration mode",
+		"Mode_open":       "Open to everyone",
+		"Mode_invite":     "Invite only",
+		"Mode_approval":   "Approval by an administrator",
+		"Mode_closed":     "Closed",
+		"RegPending":      "Your account has been created and is waiting for approval by an administrator.",
+		"RegInviteOnly":   "Registration requires an invite link.",
+		"ErrRegClosed":    "Registration is closed",
+		"ErrInvite":       "This invite link is invalid, used or expired",
+		"ErrInviteNeed":   "Registration requires an invite link",
+		"ErrPending":      "Your account is waiting for approval by an administrator",
+		"PendingUsers":    "Pending Sign-ups",
+		"NoPending":       "No pending sign-ups",
+		"Approve":         "Approve",
+		"Reject":          "Reject",
+		"Invites":         "Invites",
+		"CreateInvite":    "Create Invite",
+		"InviteURL":       "Invite link",
+		"InviteOnce":      "Copy this link now. It is shown only once and can be used for a single registration.",
+		"AttachWallet":    "Add to wallet",
+		"ValidDays":       "Valid for (days, 0 = no limit)",
+		"Expires":         "Expires",
+		"Status":          "Status",
+		"UsedBy":          "Used by",
+		"Unused":          "Not used yet",
+		"Expired":         "Expired",
+		"NoInvites":       "No invites",
+		"None":            "None",
+		"Households":      "Households",
+		"Household":       "Household",
+		"NewHousehold":    "New Household",
+		"HouseholdName":   "Household name",
+		"Members":         "Members",
+		"InviteMember":    "Invite Member",
+		"Invite":          "Invite",
+		"Invitations":     "Household invitations",
+		"InvitedBy":       "Invited by",
+		"Accept":          "Accept",
+		"Decline":         "Decline",
+		"InviteSent":      "If this user exists, they will see the invitation and join once they accept it.",
+		"Leave":           "Leave",
+		"Current":         "Current",
+		"HouseholdHelp":   "Wallets and categories belong to a household. Wallets can only be shared with members of their household.",
+		"ErrNotMember":    "The user is not a member of this household",
+		"ErrLastMember":   "The last member cannot leave a household",
+		"ErrLastOwner":    "Every wallet must keep at least one owner",
+		"Role":            "Role",
+		"RoleOwner":       "Owner",
+		"RoleEditor":      "Editor",
+		"RoleContributor": "Contributor",
+		"RoleViewer":      "Viewer",
+		"MakeOwner":       "Transfer Ownership",
+		"ErrRole":         "Your role on this wallet does not allow this",
+		"Admin":           "Admin",
+		"Console":         "Console",
+		"Users":           "Users",
+		"Wallets":         "Wallets",
+		"UserActive":      "Active",
+		"UserPending":     "Pending",
+		"UserDisabled":    "Disabled",
+		"AdminEnv":        "Admin (FAMONEY_ADMINS)",
+		"ResetPassword":   "Reset Password",
+		"PwResetHelp":     "This password is shown only once. All sessions of the user were ended.",
+		"DisableUser":     "Disable",
+		"EnableUser":      "Enable",
+		"ForceLogout":     "Log Out Everywhere",
+		"MakeAdmin":       "Make Admin",
+		"RevokeAdmin":     "Revoke Admin",
+		"Storage":         "Storage",
+		"Table":           "Table",
+		"Rows":            "Rows",
+		"Size":            "Size",
+		"Total":           "Total",
+		"RateStatus":      "Exchange Rate Status",
+		"RateProviders":   "Providers",
+		"LastFetch":       "Last Fetch",
+		"LastAttempt":     "Last Attempt",
+		"FetchError":      "Fetch Error",
+		"CurrencyCount":   "Currencies",
+		"ActiveOverride":  "Active Overrides",
+		"RefreshRates":    "Refresh Now",
+		"Never":           "Never",
+		"ErrSelf":         "You cannot do this to your own account",
+		"ErrDisabled":     "This account has been disabled",
+		"ErrCategory":     "This category does not belong to the wallet's household",
+		"CatFood":         "Food",
+		"CatHousing":      "Housing",
+		"CatTransport":    "Transport",
+		"CatShopping":     "Shopping",
+		"CatHealth":       "Health",
+		"CatLeisure":      "Leisure",
+		"CatSalary":       "Salary",
+		"CatOther":        "Other",
+		"NoCategory":      "Uncategorized",
+		"ParentCat":       "Parent Category",
+		"TopLevel":        "Top Level",
+		"ShowSubcats":     "Show subcategories",
+		"ErrCatCycle":     "A category cannot be moved under itself or one of its subcategories",
+		"KindIncome":      "Income",
+		"KindExpense":     "Expense",
+		"KindTransfer":    "Transfer",
+		"KindAdjust":      "Adjustment",
+		"CategoryKind":    "Kind",
+		"KindDefault":     "Kind of parent (expense at top level)",
+		"Income":          "Income",
+		"Expenses":        "Expenses",
+		"OtherFlows":      "Neither Income nor Expense",
+		"Net":             "Net",
+		"AmountHelp":      "Enter the amount without a sign: income categories add it and expense categories subtract it.",
+		"ErrCatKind":      "Subcategories always have the kind of their top-level category",
+		"Wallet":          "Wallet",
+		"DeleteCategory":  "Delete Category",
+		"AffectedFlows":   "Flows in this category",
+		"Subcategories":   "Subcategories",
+		"MoveFlowsTo":     "Move its flows to",
+		"ChooseCategory":  "Choose a category",
+		"DeleteCatHelp":   "Delete moves the flows to the chosen category and the subcategories up one level. Merge moves both into the chosen category. Only categories of the same kind are offered.",
+		"MergeInto":       "Merge",
+		"Cancel":          "Cancel",
+		"ErrCatKindMix":   "Flows can only be moved to a category of the same kind",
+		"ErrCatInUse":     "Choose a category for the flows of this category",
+		"ErrCatExists":    "A category with this name already exists at this level",
+		"ErrCatFlows":     "The kind cannot change while the category or its subcategories have flows; merge them into a category of the new kind instead",
+		"ErrBalanceCat":   "Balance corrections can only be booked to a transfer or adjustment category",
+		"Budgets":         "Budgets",
+		"BudgetHelp":      "Budgets cover a category and its subcategories for each month, quarter or year. Amounts are shown in the base currency; on an income category the budget is a target.",
+		"AllWallets":      "All wallets",
+		"Rollover":        "Roll over unspent",
+		"RolloverHelp":    "Add what is left of each period's budget to the next period.",
+		"Remaining":       "Remaining",
+		"BudgetAmount":    "Budget",
+		"CarriedOver":     "Carried over",
+		"NoBudgets":       "No budgets yet",
+		"NewBudget":       "New Budget",
+		"BudgetWallets":   "Limit to these wallets (none selected means all wallets):",
+		"Monthly":         "Monthly",
+		"Quarterly":       "Quarterly",
+		"Yearly":          "Yearly",
+		"ErrBudget":       "Invalid budget",
+		"ErrCurrency":     "Unknown currency",
 	},
 	"zh": {
 		"Login":           "登录",
@@ -211,16 +484,243 @@ var translations = map[string]map[string]string{
 		"EditWallet":      "编辑钱包",
 		"EditCategories":  "编辑类别",
 		"ViewCategories":  "查看类别",
-		"CategoryInUse":   "该类别在某些钱包有资金，不能删除",
 		"Summary":         "汇总",
 		"TotalBalance":    "总余额",
 		"ByCurrency":      "按货币",
 		"ByCategory":      "按类别",
 		"Close":           "关闭",
-		"AllUsers":        "系统用户",
+		"AllUsers":        "家庭成员",
 		"SharedUsers":     "已分享用户",
 		"Unshare":         "取消分享",
 		"CategoryDetails": "类别详情",
+		"Transfer":        "转账",
+		"TargetWallet":    "目标钱包",
+		"Transfers":       "转账",
+		"ErrAmount":       "金额无效",
+		"ErrSameWallet":   "转出和转入钱包不能相同",
+		"ErrNotOwner":     "您无权访问这两个钱包",
+		"ErrLedger":       "操作失败，未保存任何更改",
+		"Exchange":        "换汇",
+		"Exchanges":       "换汇",
+		"From":            "转出",
+		"To":              "转入",
+		"Rate":            "汇率",
+		"MarketRate":      "市场汇率",
+		"GainLoss":        "汇兑损益",
+		"ErrSameCurrency": "转出和转入货币不能相同",
+		"ValuedToday":     "按当前汇率估值",
+		"ValuedAtDate":    "按交易日汇率估值",
+		"Rates":           "汇率",
+		"ManualRates":     "手动汇率",
+		"RatePerUSD":      "每1美元兑换",
+		"RatesSource":     "来源",
+		"RatesUpdated":    "更新时间",
+		"Save":            "保存",
+		"RateOverrides":   "固定汇率",
+		"OverrideHelp":    "1 单位前一货币等于所填数量的后一货币。固定汇率仅对当前家庭生效，并优先于获取的汇率。",
+		"ValidFrom":       "生效日期",
+		"ValidTo":         "失效日期",
+		"Note":            "备注",
+		"Active":          "生效中",
+		"ChangePassword":  "修改密码",
+		"CurrentPassword": "当前密码",
+		"NewPassword":     "新密码",
+		"ConfirmPassword": "确认密码",
+		"PasswordSaved":   "密码已修改",
+		"ErrPassword":     "当前密码不正确",
+		"ErrPwMismatch":   "两次输入的密码不一致",
+		"ErrPwShort":      "密码至少需要 8 个字符",
+		"ErrPwLong":       "密码不能超过 72 个字节",
+		"ErrUsername":     "用户名为空或已被占用",
+		"Sessions":        "登录设备",
+		"Device":          "设备",
+		"IPAddress":       "IP 地址",
+		"SignedIn":        "登录时间",
+		"LastSeen":        "最近活动",
+		"ThisDevice":      "当前设备",
+		"Revoke":          "注销",
+		"LogoutAll":       "退出所有设备",
+		"ErrLogin":        "用户名或密码错误",
+		"Account":         "账户",
+		"TwoFactor":       "两步验证",
+		"TOTPCode":        "验证码",
+		"TOTPPrompt":      "请输入身份验证器应用中的 6 位验证码，或任一恢复码。",
+		"TOTPScan":        "用身份验证器应用扫描二维码（或手动输入密钥），然后填写应用显示的验证码以确认。",
+		"TOTPSecret":      "密钥",
+		"TOTPOn":          "两步验证已开启。",
+		"TOTPOff":         "两步验证未开启。",
+		"Enable":          "开启",
+		"Disable":         "关闭",
+		"RecoveryCodes":   "恢复码",
+		"RecoveryHelp":    "每个恢复码可代替验证码使用一次。请妥善保存，恢复码只显示这一次。",
+		"RecoveryLeft":    "未使用的恢复码",
+		"NewRecovery":     "重新生成恢复码",
+		"ErrTOTPCode":     "验证码无效",
+		"ErrTOTPActive":   "两步验证已开启",
+		"Passkeys":        "通行密钥",
+		"PasskeyHelp":     "使用指纹、面容或设备 PIN 码代替密码登录。可以为常用的每台手机或电脑各添加一个通行密钥。",
+		"AddPasskey":      "添加通行密钥",
+		"PasskeyName":     "通行密钥名称",
+		"PasskeyLogin":    "使用通行密钥登录",
+		"PasskeyOff":      "服务器未配置通行密钥。",
+		"NoPasskeys":      "尚未添加通行密钥",
+		"Created":         "创建时间",
+		"LastUsed":        "最近使用",
+		"Rename":          "重命名",
+		"ErrPasskey":      "通行密钥验证失败",
+		"ErrThrottled":    "失败次数过多，请稍后再试，剩余等待时间",
+		"Integrity":       "余额校验",
+		"IntegrityOK":     "所有钱包余额与流水一致。",
+		"IntegrityHelp":   "重建：以流水合计覆盖记录的余额。校正：保留余额，补记一笔差额校正流水。",
+		"CachedBalance":   "记录余额",
+		"FlowsTotal":      "流水合计",
+		"Difference":      "差额",
+		"Rebuild":         "重建",
+		"Correct":         "校正",
+		"RebuildAll":      "全部重建",
+		"CorrectAll":      "全部校正",
+		"ErrRepairMode":   "未知的修复方式",
+		"Registrations":   "注册管理",
+		"RegMode":         "注册方式",
+		"Mode_open":       "开放注册",
+		"Mode_invite":     "仅限邀请",
+		"Mode_approval":   "需管理员审核",
+		"Mode_closed":     "已关闭",
+		"RegPending":      "账户已创建，正在等待管理员审核。",
+		"RegInviteOnly":   "注册需要邀请链接。",
+		"ErrRegClosed":    "注册已关闭",
+		"ErrInvite":       "邀请链接无效、已使用或已过期",
+		"ErrInviteNeed":   "注册需要邀请链接",
+		"ErrPending":      "您的账户正在等待管理员审核",
+		"PendingUsers":    "待审核注册",
+		"NoPending":       "没有待审核的注册",
+		"Approve":         "批准",
+		"Reject":          "拒绝",
+		"Invites":         "邀请",
+		"CreateInvite":    "创建邀请",
+		"InviteURL":       "邀请链接",
+		"InviteOnce":      "请立即复制此链接。链接只显示这一次，且只能用于一次注册。",
+		"AttachWallet":    "加入钱包",
+		"ValidDays":       "有效天数（0 为不限）",
+		"Expires":         "过期时间",
+		"Status":          "状态",
+		"UsedBy":          "使用者",
+		"Unused":          "未使用",
+		"Expired":         "已过期",
+		"NoInvites":       "没有邀请",
+		"None":            "无",
+		"Households":      "家庭",
+		"Household":       "家庭",
+		"NewHousehold":    "新建家庭",
+		"HouseholdName":   "家庭名称",
+		"Members":         "成员",
+		"InviteMember":    "邀请成员",
+		"Invite":          "邀请",
+		"Invitations":     "家庭邀请",
+		"InvitedBy":       "邀请人",
+		"Accept":          "接受",
+		"Decline":         "拒绝",
+		"InviteSent":      "如果该用户存在，其将看到邀请，并在接受后加入。",
+		"Leave":           "退出",
+		"Current":         "当前",
+		"HouseholdHelp":   "钱包和类别属于某个家庭，钱包只能分享给同一家庭的成员。",
+		"ErrNotMember":    "该用户不是此家庭的成员",
+		"ErrLastMember":   "家庭的最后一名成员不能退出",
+		"ErrLastOwner":    "每个钱包至少需要保留一名所有者",
+		"Role":            "角色",
+		"RoleOwner":       "所有者",
+		"RoleEditor":      "编辑者",
+		"RoleContributor": "记账者",
+		"RoleViewer":      "查看者",
+		"MakeOwner":       "转让所有权",
+		"ErrRole":         "您在此钱包的角色不允许此操作",
+		"Admin":           "管理",
+		"Console":         "控制台",
+		"Users":           "用户",
+		"Wallets":         "钱包",
+		"UserActive":      "正常",
+		"UserPending":     "待审核",
+		"UserDisabled":    "已停用",
+		"AdminEnv":        "管理员（FAMONEY_ADMINS）",
+		"ResetPassword":   "重置密码",
+		"PwResetHelp":     "该密码仅显示一次，该用户的所有登录已被注销。",
+		"DisableUser":     "停用",
+		"EnableUser":      "启用",
+		"ForceLogout":     "注销所有登录",
+		"MakeAdmin":       "设为管理员",
+		"RevokeAdmin":     "取消管理员",
+		"Storage":         "存储",
+		"Table":           "数据表",
+		"Rows":            "行数",
+		"Size":            "大小",
+		"Total":           "合计",
+		"RateStatus":      "汇率状态",
+		"RateProviders":   "数据源",
+		"LastFetch":       "最近获取",
+		"LastAttempt":     "最近尝试",
+		"FetchError":      "获取错误",
+		"CurrencyCount":   "币种数",
+		"ActiveOverride":  "生效的固定汇率",
+		"RefreshRates":    "立即刷新",
+		"Never":           "从未",
+		"ErrSelf":         "不能对自己的账户执行此操作",
+		"ErrDisabled":     "该账户已被停用",
+		"ErrCategory":     "该类别不属于钱包所在的家庭",
+		"CatFood":         "餐饮",
+		"CatHousing":      "居住",
+		"CatTransport":    "交通",
+		"CatShopping":     "购物",
+		"CatHealth":       "医疗",
+		"CatLeisure":      "娱乐",
+		"CatSalary":       "工资",
+		"CatOther":        "其他",
+		"NoCategory":      "未分类",
+		"ParentCat":       "上级类别",
+		"TopLevel":        "顶级",
+		"ShowSubcats":     "展开子类别",
+		"ErrCatCycle":     "类别不能移动到自身或其子类别之下",
+		"KindIncome":      "收入",
+		"KindExpense":     "支出",
+		"KindTransfer":    "转移",
+		"KindAdjust":      "调整",
+		"CategoryKind":    "类型",
+		"KindDefault":     "同上级类别（顶级默认为支出）",
+		"Income":          "收入",
+		"Expenses":        "支出",
+		"OtherFlows":      "非收支",
+		"Net":             "净额",
+		"AmountHelp":      "输入不带正负号的金额：收入类别计为增加，支出类别计为减少。",
+		"ErrCatKind":      "子类别的类型始终与其顶级类别相同",
+		"Wallet":          "钱包",
+		"DeleteCategory":  "删除类别",
+		"AffectedFlows":   "该类别的流水数",
+		"Subcategories":   "子类别",
+		"MoveFlowsTo":     "将其流水移至",
+		"ChooseCategory":  "请选择类别",
+		"DeleteCatHelp":   "删除：流水移至所选类别，子类别上移一级。合并：流水和子类别都移入所选类别。只列出同类型的类别。",
+		"MergeInto":       "合并",
+		"Cancel":          "取消",
+		"ErrCatKindMix":   "流水只能移至同类型的类别",
+		"ErrCatInUse":     "请为该类别的流水选择新的类别",
+		"ErrCatExists":    "同一级别下已有同名类别",
+		"ErrCatFlows":     "类别或其子类别已有流水时不能更改类型，请改为将其合并到新类型的类别",
+		"ErrBalanceCat":   "余额校正只能记入转账或调整类别",
+		"Budgets":         "预算",
+		"BudgetHelp":      "预算按月、季度或年度统计某个类别及其子类别。金额以基准货币显示；收入类别的预算表示目标。",
+		"AllWallets":      "全部钱包",
+		"Rollover":        "结余转入下期",
+		"RolloverHelp":    "每期未用完的预算计入下一期。",
+		"Remaining":       "剩余",
+		"BudgetAmount":    "预算",
+		"CarriedOver":     "上期结转",
+		"NoBudgets":       "暂无预算",
+		"NewBudget":       "新建预算",
+		"BudgetWallets":   "仅统计以下钱包（不选则统计全部钱包）：",
+		"Monthly":         "每月",
+		"Quarterly":       "每季度",
+		"Yearly":          "每年",
+		"ErrBudget":       "无效的预算",
+		"ErrCurrency":     "未知的货币",
 	},
 }
 
@@ -235,14 +735,15 @@ func getBaseCurrency(w http.ResponseWriter, r *http.Request) string {
 	return "CNY"
 }
 
-var sessionsStore = map[string]int{}
-
-func newSessionID() string {
-	b := make([]byte, 16)
-	if _, err := rand.Read(b); err != nil {
-		return strconv.FormatInt(time.Now().UnixNano(), 16)
+func getValuation(w http.ResponseWriter, r *http.Request) string {
+	if v := r.FormValue("valuation"); v == valuationCurrent || v == valuationHistorical {
+		http.SetCookie(w, &http.Cookie{Name: "valuation", Value: v, Path: "/"})
+		return v
+	}
+	if c, err := r.Cookie("valuation"); err == nil && c.Value == valuationHistorical {
+		return valuationHistorical
 	}
-	return hex.EncodeToString(b)
+	return valuationCurrent
 }
 
 func initDB() {
@@ -276,7 +777,37 @@ func initDB() {
 
 func main() {
 	initDB()
+	cmd, args := "", []string{}
+	if len(os.Args) > 1 {
+		cmd, args = os.Args[1], os.Args[2:]
+	}
+	if cmd == "migrate" {
+		if err := runMigrate(args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := migrateDB(false); err != nil {
+		log.Fatal(err)
+	}
+	switch cmd {
+	case "":
+	case "check":
+		loadStoredRates()
+		if err := runCheck(args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	default:
+		log.Fatalf("unknown command %q", cmd)
+	}
+	rateProviders = newRateProviders()
+	log.Println("rate providers:", rateProviders.Name())
+	loadStoredRates()
+	loadRateOverrides()
 	updateCurrencyRates()
+	sessions = newSessionStore()
+	go sweepSessions(10 * time.Minute)
 	go func() {
 		for {
 			time.Sleep(12 * time.Hour)
@@ -288,6 +819,15 @@ func main() {
 	mux.HandleFunc("/famoney/login", loginHandler)
 	mux.HandleFunc("/famoney/register", registerHandler)
 	mux.HandleFunc("/famoney/logout", logoutHandler)
+	mux.HandleFunc("/famoney/login/totp", loginTOTPHandler)
+	mux.HandleFunc("/famoney/password", auth(passwordHandler))
+	mux.HandleFunc("/famoney/totp", auth(totpHandler))
+	mux.HandleFunc("/famoney/passkeys", auth(passkeysHandler))
+	mux.HandleFunc("/famoney/passkeys/register/begin", auth(passkeyRegisterBeginHandler))
+	mux.HandleFunc("/famoney/passkeys/register/finish", auth(passkeyRegisterFinishHandler))
+	mux.HandleFunc("/famoney/login/passkey/begin", passkeyLoginBeginHandler)
+	mux.HandleFunc("/famoney/login/passkey/finish", passkeyLoginFinishHandler)
+	mux.HandleFunc("/famoney/sessions", auth(sessionsHandler))
 	mux.HandleFunc("/famoney/dashboard", auth(dashboardHandler))
 	mux.HandleFunc("/famoney/wallet/create", auth(createWalletHandler))
 	mux.HandleFunc("/famoney/wallet/reorder", auth(reorderWalletsHandler))
@@ -296,6 +836,13 @@ func main() {
 	mux.HandleFunc("/famoney/category/update", auth(updateCategoryHandler))
 	mux.HandleFunc("/famoney/category/delete", auth(deleteCategoryHandler))
 	mux.HandleFunc("/famoney/flow/", auth(flowHandler))
+	mux.HandleFunc("/famoney/rates", auth(ratesHandler))
+	mux.HandleFunc("/famoney/households", auth(householdsHandler))
+	mux.HandleFunc("/famoney/budgets", auth(budgetsHandler))
+	mux.HandleFunc("/famoney/admin", adminAuth(adminHandler))
+	mux.HandleFunc("/famoney/admin/integrity", adminAuth(integrityHandler))
+	mux.HandleFunc("/famoney/admin/registrations", adminAuth(registrationsHandler))
+	mux.HandleFunc("/famoney/admin/rates", adminAuth(adminRatesHandler))
 	mux.Handle("/famoney/static/", http.StripPrefix("/famoney/static/", http.FileServer(http.Dir("static"))))
 
 	log.Println("Server running on :8295")
@@ -304,16 +851,17 @@ func main() {
 
 func auth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("session_id")
-		if err != nil {
+		s := requestSession(r)
+		if s == nil {
+			clearSessionCookie(w, r)
 			http.Redirect(w, r, "/famoney/login", http.StatusSeeOther)
 			return
 		}
-		if _, ok := sessionsStore[cookie.Value]; !ok {
-			http.Redirect(w, r, "/famoney/login", http.StatusSeeOther)
+		if !validCSRF(r, s) {
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
 			return
 		}
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withSession(r, s))
 	}
 }
 
@@ -340,12 +888,21 @@ func render(w http.ResponseWriter, r *http.Request, tmpl string, data map[string
 	base := getBaseCurrency(w, r)
 	funcs := template.FuncMap{
 		"T":           func(key string) string { return T(lang, key) },
-		"Convert":     convert,
+		"Convert":     convertMoney,
 		"FormatMoney": formatMoney,
+		"MoneyString": moneyString,
+		"Digits":      minorDigits,
 		"ToJSON":      func(v interface{}) template.JS { b, _ := json.Marshal(v); return template.JS(b) },
 	}
 	data["Lang"] = lang
 	data["BaseCurrency"] = base
+	data["Valuation"] = getValuation(w, r)
+	if s := requestSession(r); s != nil {
+		data["IsAdmin"] = isAdmin(s.UserID)
+		data["CSRFToken"] = s.CSRFToken
+		data["CurrentHousehold"] = currentHousehold(w, r)
+		data["MyHouseholds"], _ = userHouseholds(s.UserID)
+	}
 	if _, ok := data["Currencies"]; !ok {
 		data["Currencies"] = currencyList()
 	}
@@ -354,69 +911,263 @@ func render(w http.ResponseWriter, r *http.Request, tmpl string, data map[string
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	t.ExecuteTemplate(w, "layout", data)
+	var page bytes.Buffer
+	if err := t.ExecuteTemplate(&page, "layout", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writePage(w, r, &page)
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		username := r.FormValue("username")
 		password := r.FormValue("password")
-		var id int
-		var dbPass string
-		err := db.QueryRow("SELECT id, password FROM users WHERE username=?", username).Scan(&id, &dbPass)
-		if err == nil && dbPass == password {
-			sid := newSessionID()
-			sessionsStore[sid] = id
-			http.SetCookie(w, &http.Cookie{Name: "session_id", Value: sid, Path: "/"})
-			http.Redirect(w, r, "/famoney/dashboard", http.StatusSeeOther)
+		ip := clientIP(r)
+		if wait := loginThrottle.wait(username, ip, time.Now()); wait > 0 {
+			auditLoginFailure(username, ip, r.UserAgent(), "throttled")
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			render(w, r, "login.html", map[string]interface{}{"Error": errThrottled.Error(), "RetryAfter": wait.Round(time.Second).String(), "Username": username})
 			return
 		}
+		if id := authenticate(username, password); id != 0 {
+			if err := accountError(id); err != nil {
+				render(w, r, "login.html", map[string]interface{}{"Error": err.Error(), "Username": username})
+				return
+			}
+			if totpRequired(id) {
+				pid, err := addPendingLogin(id, username)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				http.SetCookie(w, &http.Cookie{Name: pendingCookie, Value: pid, Path: "/famoney/login", MaxAge: int(pendingTTL / time.Second), HttpOnly: true, Secure: secureCookies(r), SameSite: http.SameSiteLaxMode})
+				http.Redirect(w, r, "/famoney/login/totp", http.StatusSeeOther)
+				return
+			}
+			loginThrottle.succeed(username, ip)
+			startSession(w, r, id)
+			return
+		}
+		loginThrottle.fail(username, ip, time.Now())
+		auditLoginFailure(username, ip, r.UserAgent(), "password")
+		render(w, r, "login.html", map[string]interface{}{"Error": errLogin.Error(), "Username": username})
+		return
 	}
 	render(w, r, "login.html", map[string]interface{}{})
 }
 
+// startSession logs uid in on this browser and sends it to the dashboard.
+func startSession(w http.ResponseWriter, r *http.Request, uid int) {
+	s, err := sessions.Create(uid, r.UserAgent(), clientIP(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, s)
+	http.Redirect(w, r, "/famoney/dashboard", http.StatusSeeOther)
+}
+
+// loginTOTPHandler is the second login step for users with two-factor
+// authentication enabled.
+func loginTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(pendingCookie)
+	var p *pendingLogin
+	if err == nil {
+		p = getPendingLogin(cookie.Value)
+	}
+	if p == nil {
+		http.Redirect(w, r, "/famoney/login", http.StatusSeeOther)
+		return
+	}
+	if r.Method == "POST" {
+		ip := clientIP(r)
+		if wait := loginThrottle.wait(p.Username, ip, time.Now()); wait > 0 {
+			auditLoginFailure(p.Username, ip, r.UserAgent(), "throttled")
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			render(w, r, "login_totp.html", map[string]interface{}{"Error": errThrottled.Error(), "RetryAfter": wait.Round(time.Second).String()})
+			return
+		}
+		err := checkSecondFactor(p.UserID, r.FormValue("code"))
+		if err == nil {
+			err = accountError(p.UserID)
+		}
+		if err == nil {
+			dropPendingLogin(cookie.Value)
+			http.SetCookie(w, &http.Cookie{Name: pendingCookie, Value: "", Path: "/famoney/login", MaxAge: -1})
+			loginThrottle.succeed(p.Username, ip)
+			startSession(w, r, p.UserID)
+			return
+		}
+		if err == errTOTPCode {
+			loginThrottle.fail(p.Username, ip, time.Now())
+			auditLoginFailure(p.Username, ip, r.UserAgent(), "totp")
+		}
+		render(w, r, "login_totp.html", map[string]interface{}{"Error": errorKey(err)})
+		return
+	}
+	render(w, r, "login_totp.html", map[string]interface{}{})
+}
+
 func registerHandler(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"Mode":   registrationMode,
+		"Invite": r.FormValue("invite"),
+	}
 	if r.Method == "POST" {
-		username := r.FormValue("username")
-		password := r.FormValue("password")
-		if _, err := db.Exec("INSERT INTO users (username, password) VALUES (?, ?)", username, password); err == nil {
+		username := strings.TrimSpace(r.FormValue("username"))
+		pending, err := registerUser(username, r.FormValue("password"), r.FormValue("confirm"), r.FormValue("invite"))
+		if err == nil && !pending {
 			http.Redirect(w, r, "/famoney/login", http.StatusSeeOther)
 			return
 		}
+		if err != nil {
+			data["Error"] = errorKey(err)
+			data["Username"] = username
+		}
+		data["Pending"] = pending
+	}
+	render(w, r, "register.html", data)
+}
+
+func passwordHandler(w http.ResponseWriter, r *http.Request) {
+	uid := currentUser(r)
+	data := map[string]interface{}{}
+	if r.Method == "POST" {
+		if err := changePassword(uid, r.FormValue("current"), r.FormValue("password"), r.FormValue("confirm")); err != nil {
+			data["Error"] = errorKey(err)
+		} else {
+			data["Saved"] = true
+		}
 	}
-	render(w, r, "register.html", map[string]interface{}{})
+	render(w, r, "password.html", data)
+}
+
+func totpHandler(w http.ResponseWriter, r *http.Request) {
+	uid := currentUser(r)
+	data := map[string]interface{}{}
+	if r.Method == "POST" {
+		var codes []string
+		var err error
+		switch r.FormValue("action") {
+		case "enable":
+			codes, err = enableTOTP(uid, r.FormValue("code"))
+		case "recovery":
+			if err = checkSecondFactor(uid, r.FormValue("code")); err == nil {
+				codes, err = regenerateRecoveryCodes(uid)
+			}
+		case "disable":
+			if err = verifyPassword(uid, r.FormValue("password")); err == nil {
+				err = disableTOTP(uid)
+			}
+		}
+		if err != nil {
+			data["Error"] = errorKey(err)
+		}
+		data["RecoveryCodes"] = codes
+	}
+	st, err := loadTOTP(uid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data["Enabled"] = st.Enabled
+	if st.Enabled {
+		data["Remaining"] = remainingRecoveryCodes(uid)
+	} else {
+		var username string
+		db.QueryRow("SELECT username FROM users WHERE id=?", uid).Scan(&username)
+		secret, err := startTOTPEnrollment(uid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		qr, err := totpQR(totpURI(secret, username))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data["Secret"] = secret
+		data["QR"] = qr
+	}
+	render(w, r, "totp.html", data)
+}
+
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	current := requestSession(r)
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "revoke":
+			list, err := sessions.List(current.UserID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, s := range list {
+				if s.Handle() == r.FormValue("session") {
+					if err := sessions.Delete(s.ID); err != nil {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
+				}
+			}
+		case "revoke_all":
+			if err := sessions.DeleteUser(current.UserID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			clearSessionCookie(w, r)
+			http.Redirect(w, r, "/famoney/login", http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/famoney/sessions", http.StatusSeeOther)
+		return
+	}
+	list, err := sessions.List(current.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := map[string]interface{}{
+		"Sessions": list,
+		"Current":  current.Handle(),
+	}
+	render(w, r, "sessions.html", data)
 }
 
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	if cookie, err := r.Cookie("session_id"); err == nil {
-		delete(sessionsStore, cookie.Value)
-		http.SetCookie(w, &http.Cookie{Name: "session_id", Value: "", Path: "/", MaxAge: -1})
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if err := sessions.Delete(cookie.Value); err != nil {
+			log.Println("failed to delete session", err)
+		}
+		clearSessionCookie(w, r)
 	}
 	http.Redirect(w, r, "/famoney/login", http.StatusSeeOther)
 }
 
 func dashboardHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, _ := r.Cookie("session_id")
-	uid := sessionsStore[cookie.Value]
+	uid := currentUser(r)
+	hid := currentHousehold(w, r)
 	base := getBaseCurrency(w, r)
+	valuation := getValuation(w, r)
 
-	rows, err := db.Query("SELECT w.id, w.name, IFNULL(w.color, '#b5651d') FROM wallets w JOIN wallet_owners o ON w.id=o.wallet_id WHERE o.user_id=? ORDER BY o.display_order, w.id", uid)
+	rows, err := db.Query("SELECT w.id, w.name, IFNULL(w.color, '#b5651d') FROM wallets w JOIN wallet_owners o ON w.id=o.wallet_id WHERE o.user_id=? AND w.household_id=? ORDER BY o.display_order, w.id", uid, hid)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 	userWallets := []*Wallet{}
-	currencyTotals := map[string]float64{}
+	currencyTotals := map[string]int64{}
 	walletIDs := []int{}
 	walletNames := map[int]string{}
 	for rows.Next() {
-		w := &Wallet{Balances: map[string]float64{}}
+		w := &Wallet{Balances: map[string]int64{}}
 		if err := rows.Scan(&w.ID, &w.Name, &w.Color); err == nil {
 			balRows, _ := db.Query("SELECT currency, balance FROM wallet_balances WHERE wallet_id=?", w.ID)
 			for balRows.Next() {
 				var cur string
-				var bal float64
+				var bal int64
 				if err := balRows.Scan(&cur, &bal); err == nil {
 					w.Balances[cur] = bal
 					currencyTotals[cur] += bal
@@ -430,45 +1181,28 @@ func dashboardHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	filterBalances(currencyTotals, base)
-	totalBalance := 0.0
+	var totalBalance int64
 	for cur, bal := range currencyTotals {
-		totalBalance += convert(bal, cur, base)
+		totalBalance += convertMoney(hid, bal, cur, base)
 	}
 
-	catRows, _ := db.Query("SELECT id, name FROM categories")
-	categories := []*Category{}
+	categories, _ := householdCategories(hid)
 	categoriesMap := map[int]*Category{}
-	for catRows.Next() {
-		c := &Category{}
-		if err := catRows.Scan(&c.ID, &c.Name); err == nil {
-			categories = append(categories, c)
-			categoriesMap[c.ID] = c
-		}
-	}
-
-	categoryTotals := map[int]float64{}
-	categoryWallets := map[int]map[string]float64{}
-	if len(walletIDs) > 0 {
-		placeholders := make([]string, len(walletIDs))
-		args := make([]interface{}, len(walletIDs))
-		for i, id := range walletIDs {
-			placeholders[i] = "?"
-			args[i] = id
-		}
-		q := fmt.Sprintf("SELECT wallet_id, category_id, SUM(amount), currency FROM flows WHERE wallet_id IN (%s) GROUP BY wallet_id, category_id, currency", strings.Join(placeholders, ","))
-		rows2, _ := db.Query(q, args...)
-		for rows2.Next() {
-			var wid, cid int
-			var sum float64
-			var cur string
-			if err := rows2.Scan(&wid, &cid, &sum, &cur); err == nil {
-				conv := convert(sum, cur, base)
-				categoryTotals[cid] += conv
-				if categoryWallets[cid] == nil {
-					categoryWallets[cid] = map[string]float64{}
-				}
-				categoryWallets[cid][walletNames[wid]] += conv
+	for _, c := range categories {
+		categoriesMap[c.ID] = c
+	}
+
+	categoryTotals := map[int]int64{}
+	categoryWallets := map[int]map[string]int64{}
+	totals, _ := queryFlowTotals(walletIDs, flowNormal)
+	for _, t := range totals {
+		conv := t.Value(hid, base, valuation)
+		for _, cid := range withAncestors(t.CategoryID, categoriesMap) {
+			categoryTotals[cid] += conv
+			if categoryWallets[cid] == nil {
+				categoryWallets[cid] = map[string]int64{}
 			}
+			categoryWallets[cid][walletNames[t.WalletID]] += conv
 		}
 	}
 
@@ -479,38 +1213,38 @@ func dashboardHandler(w http.ResponseWriter, r *http.Request) {
 		"Currencies":      currencyList(),
 		"CurrencyTotals":  currencyTotals,
 		"CategoryTotals":  categoryTotals,
+		"Report":          categoryReport(categoryRows(categories, categoryTotals)),
+		"CategoryKinds":   categoryKinds,
+		"KindKeys":        categoryKindKeys,
 		"CategoryWallets": categoryWallets,
 		"TotalBalance":    totalBalance,
+		"Household":       hid,
 	}
-	if r.URL.Query().Get("err") == "category_in_use" {
-		data["CategoryInUse"] = true
+	if errKey := r.URL.Query().Get("err"); errKey != "" {
+		if _, ok := translations["en"][errKey]; ok {
+			data["Error"] = errKey
+		}
 	}
 	render(w, r, "dashboard.html", data)
 }
 
 func createWalletHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, _ := r.Cookie("session_id")
-	uid := sessionsStore[cookie.Value]
+	uid := currentUser(r)
 	name := r.FormValue("name")
 	currency := r.FormValue("currency")
 	color := r.FormValue("color")
 	if color == "" {
 		color = "#b5651d"
 	}
-	res, err := db.Exec("INSERT INTO wallets (name, color) VALUES (?, ?)", name, color)
-	if err == nil {
-		wid, _ := res.LastInsertId()
-		var order int
-		db.QueryRow("SELECT IFNULL(MAX(display_order), 0) + 1 FROM wallet_owners WHERE user_id=?", uid).Scan(&order)
-		db.Exec("INSERT INTO wallet_owners (wallet_id, user_id, display_order) VALUES (?, ?, ?)", wid, uid, order)
-		db.Exec("INSERT INTO wallet_balances (wallet_id, currency, balance) VALUES (?, ?, 0)", wid, currency)
+	if err := createWallet(uid, currentHousehold(w, r), name, color, currency); err != nil {
+		http.Redirect(w, r, "/famoney/dashboard?err="+errorKey(err), http.StatusSeeOther)
+		return
 	}
 	http.Redirect(w, r, "/famoney/dashboard", http.StatusSeeOther)
 }
 
 func reorderWalletsHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, _ := r.Cookie("session_id")
-	uid := sessionsStore[cookie.Value]
+	uid := currentUser(r)
 	var payload struct {
 		Order []int `json:"order"`
 	}
@@ -518,44 +1252,48 @@ func reorderWalletsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	for i, wid := range payload.Order {
-		db.Exec("UPDATE wallet_owners SET display_order=? WHERE wallet_id=? AND user_id=?", i, wid, uid)
+	err := withTx(func(tx *sql.Tx) error {
+		for i, wid := range payload.Order {
+			if _, err := tx.Exec("UPDATE wallet_owners SET display_order=? WHERE wallet_id=? AND user_id=?", i, wid, uid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
 func viewWalletHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, _ := r.Cookie("session_id")
-	uid := sessionsStore[cookie.Value]
+	uid := currentUser(r)
 	base := getBaseCurrency(w, r)
+	valuation := getValuation(w, r)
 	path := strings.TrimPrefix(r.URL.Path, "/famoney/wallet/")
 	if strings.HasSuffix(path, "/delete") && r.Method == "POST" {
 		idStr := strings.TrimSuffix(path, "/delete")
 		id, _ := strconv.Atoi(idStr)
-		var count int
-		db.QueryRow("SELECT COUNT(*) FROM wallet_owners WHERE wallet_id=? AND user_id=?", id, uid).Scan(&count)
-		if count == 0 {
+		if !ownsWallet(uid, id) {
 			http.NotFound(w, r)
 			return
 		}
-		db.Exec("DELETE FROM flows WHERE wallet_id=?", id)
-		db.Exec("DELETE FROM wallet_balances WHERE wallet_id=?", id)
-		db.Exec("DELETE FROM wallet_owners WHERE wallet_id=?", id)
-		db.Exec("DELETE FROM wallets WHERE id=?", id)
+		if err := deleteWallet(uid, id); err != nil {
+			http.Redirect(w, r, fmt.Sprintf("/famoney/wallet/%d?err=%s", id, errorKey(err)), http.StatusSeeOther)
+			return
+		}
 		http.Redirect(w, r, "/famoney/dashboard", http.StatusSeeOther)
 		return
 	}
 	id, _ := strconv.Atoi(path)
-
-	var count int
-	db.QueryRow("SELECT COUNT(*) FROM wallet_owners WHERE wallet_id=? AND user_id=?", id, uid).Scan(&count)
-	if count == 0 {
+	if !ownsWallet(uid, id) {
 		http.NotFound(w, r)
 		return
 	}
 
-	wallet := &Wallet{Balances: map[string]float64{}}
-	err := db.QueryRow("SELECT id, name, IFNULL(color, '#b5651d') FROM wallets WHERE id=?", id).Scan(&wallet.ID, &wallet.Name, &wallet.Color)
+	wallet := &Wallet{Balances: map[string]int64{}}
+	err := db.QueryRow("SELECT id, name, IFNULL(color, '#b5651d'), IFNULL(household_id, 0) FROM wallets WHERE id=?", id).Scan(&wallet.ID, &wallet.Name, &wallet.Color, &wallet.HouseholdID)
 	if err != nil {
 		http.NotFound(w, r)
 		return
@@ -563,62 +1301,115 @@ func viewWalletHandler(w http.ResponseWriter, r *http.Request) {
 	balRows, _ := db.Query("SELECT currency, balance FROM wallet_balances WHERE wallet_id=?", wallet.ID)
 	for balRows.Next() {
 		var cur string
-		var bal float64
+		var bal int64
 		if err := balRows.Scan(&cur, &bal); err == nil {
 			wallet.Balances[cur] = bal
 		}
 	}
 	filterBalances(wallet.Balances, base)
 
+	var exchange *Exchange
+	errKey := r.URL.Query().Get("err")
+	if _, ok := translations["en"][errKey]; !ok {
+		errKey = ""
+	}
 	if r.Method == "POST" {
 		action := r.FormValue("action")
 		switch action {
+		case "transfer":
+			target, _ := strconv.Atoi(r.FormValue("target"))
+			cur := r.FormValue("currency")
+			desc := r.FormValue("description")
+			amount, err := parseMoney(r.FormValue("amount"), cur)
+			if err == nil {
+				err = transferFunds(uid, wallet.ID, target, amount, cur, desc)
+			}
+			if err != nil {
+				errKey = errorKey(err)
+			}
+		case "exchange":
+			fromCur := r.FormValue("from_currency")
+			toCur := r.FormValue("to_currency")
+			desc := r.FormValue("description")
+			fromAmount, err := parseMoney(r.FormValue("from_amount"), fromCur)
+			toAmount, err2 := parseMoney(r.FormValue("to_amount"), toCur)
+			if err == nil {
+				err = err2
+			}
+			if err == nil {
+				exchange, err = exchangeCurrency(uid, wallet.ID, fromAmount, fromCur, toAmount, toCur, desc)
+			}
+			if err != nil {
+				errKey = errorKey(err)
+			}
 		case "flow":
-			amount, _ := strconv.ParseFloat(r.FormValue("amount"), 64)
 			categoryID, _ := strconv.Atoi(r.FormValue("category"))
 			desc := r.FormValue("description")
 			cur := r.FormValue("currency")
-			db.Exec("INSERT INTO wallet_balances (wallet_id, currency, balance) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE balance=balance+VALUES(balance)", wallet.ID, cur, amount)
-			db.Exec("INSERT INTO flows (wallet_id, amount, currency, category_id, description, created_at, operator_id) VALUES (?, ?, ?, ?, ?, ?, ?)", wallet.ID, amount, cur, categoryID, desc, time.Now(), uid)
+			amount, err := parseMoney(r.FormValue("amount"), cur)
+			if err == nil {
+				err = addFlow(uid, wallet.ID, amount, cur, categoryID, desc)
+			}
+			if err != nil {
+				errKey = errorKey(err)
+			}
 		case "balance":
-			amount, _ := strconv.ParseFloat(r.FormValue("amount"), 64)
 			categoryID, _ := strconv.Atoi(r.FormValue("category"))
 			desc := r.FormValue("description")
 			cur := r.FormValue("currency")
-			var old float64
-			db.QueryRow("SELECT balance FROM wallet_balances WHERE wallet_id=? AND currency=?", wallet.ID, cur).Scan(&old)
-			diff := amount - old
-			db.Exec("INSERT INTO wallet_balances (wallet_id, currency, balance) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE balance=VALUES(balance)", wallet.ID, cur, amount)
-			db.Exec("INSERT INTO flows (wallet_id, amount, currency, category_id, description, created_at, operator_id) VALUES (?, ?, ?, ?, ?, ?, ?)", wallet.ID, diff, cur, categoryID, desc, time.Now(), uid)
-		case "share":
-			username := r.FormValue("username")
-			var uid2 int
-			if err := db.QueryRow("SELECT id FROM users WHERE username=?", username).Scan(&uid2); err == nil {
-				var order int
-				db.QueryRow("SELECT IFNULL(MAX(display_order), 0) + 1 FROM wallet_owners WHERE user_id=?", uid2).Scan(&order)
-				db.Exec("INSERT IGNORE INTO wallet_owners (wallet_id, user_id, display_order) VALUES (?, ?, ?)", wallet.ID, uid2, order)
+			amount, err := parseMoney(r.FormValue("amount"), cur)
+			if err == nil {
+				err = setBalance(uid, wallet.ID, amount, cur, categoryID, desc)
+			}
+			if err != nil {
+				errKey = errorKey(err)
+			}
+		case "share", "role":
+			uid2 := memberID(wallet.HouseholdID, r.FormValue("username"))
+			err := errNotMember
+			if uid2 != 0 {
+				err = shareWallet(uid, wallet.ID, uid2, r.FormValue("role"))
+			}
+			if err != nil {
+				errKey = errorKey(err)
 			}
-		case "unshare":
-			username := r.FormValue("username")
+		case "unshare", "transfer_owner":
 			var uid2 int
-			if err := db.QueryRow("SELECT id FROM users WHERE username=?", username).Scan(&uid2); err == nil {
-				db.Exec("DELETE FROM wallet_owners WHERE wallet_id=? AND user_id=?", wallet.ID, uid2)
+			db.QueryRow("SELECT id FROM users WHERE username=?", r.FormValue("username")).Scan(&uid2)
+			var err error
+			if action == "unshare" {
+				err = unshareWallet(uid, wallet.ID, uid2)
+			} else {
+				err = transferOwnership(uid, wallet.ID, uid2)
+			}
+			if err != nil {
+				errKey = errorKey(err)
+			} else if uid2 == uid && action == "unshare" {
+				http.Redirect(w, r, "/famoney/dashboard", http.StatusSeeOther)
+				return
 			}
 		case "rename":
+			if !hasRole(uid, wallet.ID, roleOwner) {
+				errKey = errRole.Error()
+				break
+			}
 			name := r.FormValue("name")
 			color := r.FormValue("color")
 			if color == "" {
 				color = "#b5651d"
 			}
-			db.Exec("UPDATE wallets SET name=?, color=? WHERE id=?", name, color, wallet.ID)
+			if _, err := db.Exec("UPDATE wallets SET name=?, color=? WHERE id=?", name, color, wallet.ID); err != nil {
+				errKey = errorKey(err)
+				break
+			}
 			wallet.Name = name
 			wallet.Color = color
 		}
 		balRows, _ := db.Query("SELECT currency, balance FROM wallet_balances WHERE wallet_id=?", wallet.ID)
-		wallet.Balances = map[string]float64{}
+		wallet.Balances = map[string]int64{}
 		for balRows.Next() {
 			var cur string
-			var bal float64
+			var bal int64
 			if err := balRows.Scan(&cur, &bal); err == nil {
 				wallet.Balances[cur] = bal
 			}
@@ -626,118 +1417,119 @@ func viewWalletHandler(w http.ResponseWriter, r *http.Request) {
 		filterBalances(wallet.Balances, base)
 	}
 
-	wallet.CategoryBalances = map[int]float64{}
-	balRows2, _ := db.Query("SELECT category_id, SUM(amount), currency FROM flows WHERE wallet_id=? GROUP BY category_id, currency", wallet.ID)
-	for balRows2.Next() {
-		var cid int
-		var sum float64
-		var cur string
-		if err := balRows2.Scan(&cid, &sum, &cur); err == nil {
-			wallet.CategoryBalances[cid] += convert(sum, cur, base)
+	wallet.CategoryBalances = map[int]int64{}
+	totals, _ := queryFlowTotals([]int{wallet.ID})
+	for _, t := range totals {
+		switch t.Kind {
+		case flowTransfer:
+			wallet.TransferBalance += t.Value(wallet.HouseholdID, base, valuation)
+		case flowExchange:
+			wallet.ExchangeBalance += t.Value(wallet.HouseholdID, base, valuation)
+		default:
+			wallet.CategoryBalances[t.CategoryID] += t.Value(wallet.HouseholdID, base, valuation)
 		}
 	}
 
-	flowRows, _ := db.Query("SELECT f.id, f.wallet_id, f.amount, f.currency, f.category_id, f.description, f.created_at, u.id, u.username FROM flows f LEFT JOIN users u ON f.operator_id=u.id WHERE f.wallet_id=? ORDER BY f.created_at DESC", wallet.ID)
+	flowRows, _ := db.Query("SELECT f.id, f.wallet_id, f.amount, f.currency, IFNULL(f.category_id, 0), f.description, f.created_at, u.id, u.username, f.kind, IFNULL(lw.name, ''), IFNULL(f.rate, 0), IFNULL(f.market_rate, 0) FROM flows f LEFT JOIN users u ON f.operator_id=u.id LEFT JOIN flows lf ON f.linked_flow_id=lf.id LEFT JOIN wallets lw ON lf.wallet_id=lw.id WHERE f.wallet_id=? ORDER BY f.created_at DESC", wallet.ID)
 	walletFlows := []*Flow{}
 	for flowRows.Next() {
 		f := &Flow{}
-		if err := flowRows.Scan(&f.ID, &f.WalletID, &f.Amount, &f.Currency, &f.CategoryID, &f.Description, &f.CreatedAt, &f.OperatorID, &f.Operator); err == nil {
+		if err := flowRows.Scan(&f.ID, &f.WalletID, &f.Amount, &f.Currency, &f.CategoryID, &f.Description, &f.CreatedAt, &f.OperatorID, &f.Operator, &f.Kind, &f.Counterparty, &f.Rate, &f.MarketRate); err == nil {
 			walletFlows = append(walletFlows, f)
 		}
 	}
 
-	catRows, _ := db.Query("SELECT id, name FROM categories")
-	categories := map[int]*Category{}
-	for catRows.Next() {
-		c := &Category{}
-		if err := catRows.Scan(&c.ID, &c.Name); err == nil {
-			categories[c.ID] = c
-		}
-	}
-	userRows, _ := db.Query("SELECT username FROM users")
-	users := []string{}
-	for userRows.Next() {
-		var u string
-		if err := userRows.Scan(&u); err == nil {
-			users = append(users, u)
+	targetRows, _ := db.Query("SELECT w.id, w.name FROM wallets w JOIN wallet_owners o ON w.id=o.wallet_id WHERE o.user_id=? AND w.id<>? AND w.household_id=? ORDER BY o.display_order, w.id", uid, wallet.ID, wallet.HouseholdID)
+	targets := []*Wallet{}
+	for targetRows.Next() {
+		t := &Wallet{}
+		if err := targetRows.Scan(&t.ID, &t.Name); err == nil {
+			targets = append(targets, t)
 		}
 	}
 
-	ownerRows, _ := db.Query("SELECT u.username FROM users u JOIN wallet_owners o ON u.id=o.user_id WHERE o.wallet_id=?", wallet.ID)
-	owners := []string{}
-	for ownerRows.Next() {
-		var u string
-		if err := ownerRows.Scan(&u); err == nil {
-			owners = append(owners, u)
-		}
+	catList, _ := householdCategories(wallet.HouseholdID)
+	categories := map[int]*Category{}
+	for _, c := range catList {
+		categories[c.ID] = c
 	}
+	wallet.CategoryBalances = rollUp(wallet.CategoryBalances, categories)
+	users, _ := householdMembers(wallet.HouseholdID)
+
+	members, _ := walletMembers(wallet.ID)
+	role := walletRole(uid, wallet.ID)
 	var currentUser string
 	db.QueryRow("SELECT username FROM users WHERE id=?", uid).Scan(&currentUser)
 
 	data := map[string]interface{}{
-		"Wallet":      wallet,
-		"Flows":       walletFlows,
-		"Categories":  categories,
-		"Currencies":  currencyList(),
-		"Users":       users,
-		"Owners":      owners,
-		"CurrentUser": currentUser,
+		"Wallet":       wallet,
+		"Flows":        walletFlows,
+		"Categories":   categories,
+		"CategoryList": catList,
+		"Report":       categoryReport(categoryRows(catList, wallet.CategoryBalances)),
+		"KindKeys":     categoryKindKeys,
+		"Currencies":   currencyList(),
+		"Users":        users,
+		"Members":      members,
+		"Roles":        walletRoles,
+		"RoleKeys":     roleKeys,
+		"CanAdd":       hasRole(uid, wallet.ID, roleContributor),
+		"CanEdit":      hasRole(uid, wallet.ID, roleEditor),
+		"CanManage":    role == roleOwner,
+		"CurrentUser":  currentUser,
+		"Targets":      targets,
+		"Error":        errKey,
+		"Exchange":     exchange,
 	}
 	render(w, r, "wallet.html", data)
 }
 
 func flowHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, _ := r.Cookie("session_id")
-	uid := sessionsStore[cookie.Value]
+	uid := currentUser(r)
 	path := strings.TrimPrefix(r.URL.Path, "/famoney/flow/")
 	if strings.HasSuffix(path, "/delete") && r.Method == "POST" {
 		idStr := strings.TrimSuffix(path, "/delete")
 		id, _ := strconv.Atoi(idStr)
-		var wid int
-		var amount float64
-		var cur string
-		db.QueryRow("SELECT wallet_id, amount, currency FROM flows WHERE id=?", id).Scan(&wid, &amount, &cur)
-		var count int
-		db.QueryRow("SELECT COUNT(*) FROM wallet_owners WHERE wallet_id=? AND user_id=?", wid, uid).Scan(&count)
-		if count == 0 {
+		wid := flowWallet(uid, id)
+		if wid == 0 {
 			http.NotFound(w, r)
 			return
 		}
-		db.Exec("UPDATE wallet_balances SET balance=balance-? WHERE wallet_id=? AND currency=?", amount, wid, cur)
-		db.Exec("DELETE FROM flows WHERE id=?", id)
+		if err := deleteFlow(uid, id); err != nil {
+			http.Redirect(w, r, fmt.Sprintf("/famoney/wallet/%d?err=%s", wid, errorKey(err)), http.StatusSeeOther)
+			return
+		}
 		http.Redirect(w, r, fmt.Sprintf("/famoney/wallet/%d", wid), http.StatusSeeOther)
 		return
 	}
 	if strings.HasSuffix(path, "/edit") {
 		idStr := strings.TrimSuffix(path, "/edit")
 		id, _ := strconv.Atoi(idStr)
-		f := &Flow{}
-		db.QueryRow("SELECT wallet_id, amount, currency, category_id, description FROM flows WHERE id=?", id).Scan(&f.WalletID, &f.Amount, &f.Currency, &f.CategoryID, &f.Description)
-		var count int
-		db.QueryRow("SELECT COUNT(*) FROM wallet_owners WHERE wallet_id=? AND user_id=?", f.WalletID, uid).Scan(&count)
-		if count == 0 {
+		f := &Flow{ID: id}
+		db.QueryRow("SELECT wallet_id, amount, currency, IFNULL(category_id, 0), description, kind, created_at FROM flows WHERE id=?", id).Scan(&f.WalletID, &f.Amount, &f.Currency, &f.CategoryID, &f.Description, &f.Kind, &f.CreatedAt)
+		if !hasRole(uid, f.WalletID, roleEditor) {
 			http.NotFound(w, r)
 			return
 		}
 		if r.Method == "POST" {
-			newAmount, _ := strconv.ParseFloat(r.FormValue("amount"), 64)
 			newCurrency := r.FormValue("currency")
+			if f.Kind == flowExchange {
+				newCurrency = f.Currency
+			}
 			newCategoryID, _ := strconv.Atoi(r.FormValue("category"))
 			newDesc := r.FormValue("description")
-			db.Exec("UPDATE wallet_balances SET balance=balance-? WHERE wallet_id=? AND currency=?", f.Amount, f.WalletID, f.Currency)
-			db.Exec("INSERT INTO wallet_balances (wallet_id, currency, balance) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE balance=balance+VALUES(balance)", f.WalletID, newCurrency, newAmount)
-			db.Exec("UPDATE flows SET amount=?, currency=?, category_id=?, description=?, operator_id=? WHERE id=?", newAmount, newCurrency, newCategoryID, newDesc, uid, id)
+			newAmount, err := parseMoney(r.FormValue("amount"), newCurrency)
+			if err == nil {
+				err = updateFlow(uid, f.ID, newAmount, newCurrency, newCategoryID, newDesc)
+			}
+			if err != nil {
+				http.Redirect(w, r, fmt.Sprintf("/famoney/wallet/%d?err=%s", f.WalletID, errorKey(err)), http.StatusSeeOther)
+				return
+			}
 			http.Redirect(w, r, fmt.Sprintf("/famoney/wallet/%d", f.WalletID), http.StatusSeeOther)
 			return
 		}
-		catRows, _ := db.Query("SELECT id, name FROM categories")
-		categories := []*Category{}
-		for catRows.Next() {
-			c := &Category{}
-			if err := catRows.Scan(&c.ID, &c.Name); err == nil {
-				categories = append(categories, c)
-			}
-		}
+		categories, _ := householdCategories(walletHousehold(f.WalletID))
 		data := map[string]interface{}{
 			"Flow":       f,
 			"Categories": categories,
@@ -750,34 +1542,170 @@ func flowHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func addCategoryHandler(w http.ResponseWriter, r *http.Request) {
-	name := r.FormValue("name")
+	uid := currentUser(r)
+	hid := currentHousehold(w, r)
+	name := strings.TrimSpace(r.FormValue("name"))
+	parent, _ := strconv.Atoi(r.FormValue("parent"))
 	if name != "" {
-		db.Exec("INSERT INTO categories (name) VALUES (?) ON DUPLICATE KEY UPDATE name=name", name)
+		if err := createCategory(uid, hid, parent, name, r.FormValue("kind")); err != nil {
+			http.Redirect(w, r, "/famoney/dashboard?err="+errorKey(err), http.StatusSeeOther)
+			return
+		}
 	}
 	http.Redirect(w, r, "/famoney/dashboard", http.StatusSeeOther)
 }
 
 func updateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	uid := currentUser(r)
 	idStr := r.FormValue("id")
 	name := r.FormValue("name")
 	if idStr != "" && name != "" {
 		id, _ := strconv.Atoi(idStr)
-		db.Exec("UPDATE categories SET name=? WHERE id=?", name, id)
+		parent := -1
+		if v := r.FormValue("parent"); v != "" {
+			parent, _ = strconv.Atoi(v)
+		}
+		if err := updateCategory(uid, id, name, r.FormValue("kind"), parent); err != nil {
+			http.Redirect(w, r, "/famoney/dashboard?err="+errorKey(err), http.StatusSeeOther)
+			return
+		}
 	}
 	http.Redirect(w, r, "/famoney/dashboard", http.StatusSeeOther)
 }
 
-func deleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
-	idStr := r.FormValue("id")
-	if idStr != "" {
-		id, _ := strconv.Atoi(idStr)
-		var count int
-		db.QueryRow("SELECT COUNT(*) FROM flows WHERE category_id=?", id).Scan(&count)
-		if count > 0 {
-			http.Redirect(w, r, "/famoney/dashboard?err=category_in_use", http.StatusSeeOther)
+// ratesHandler manages the rate overrides of the current household.
+func ratesHandler(w http.ResponseWriter, r *http.Request) {
+	uid := currentUser(r)
+	hid := currentHousehold(w, r)
+	if r.Method == "POST" {
+		cur := strings.ToUpper(strings.TrimSpace(r.FormValue("currency")))
+		var err error
+		switch r.FormValue("action") {
+		case "override":
+			to := strings.ToUpper(strings.TrimSpace(r.FormValue("to_currency")))
+			rate, perr := strconv.ParseFloat(r.FormValue("rate"), 64)
+			if len(cur) == 3 && len(to) == 3 && cur != to && perr == nil && rate > 0 {
+				err = addOverride(uid, &RateOverride{HouseholdID: hid, From: cur, To: to, Rate: rate, ValidFrom: formDate(r, "valid_from"), ValidTo: formDate(r, "valid_to"), Note: r.FormValue("note")})
+			}
+		case "delete_override":
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			err = deleteOverride(uid, id)
+		}
+		if err != nil {
+			http.Redirect(w, r, "/famoney/rates?err="+errorKey(err), http.StatusSeeOther)
 			return
 		}
-		db.Exec("DELETE FROM categories WHERE id=?", id)
+		http.Redirect(w, r, "/famoney/rates", http.StatusSeeOther)
+		return
 	}
-	http.Redirect(w, r, "/famoney/dashboard", http.StatusSeeOther)
+	data := map[string]interface{}{
+		"Overrides": householdOverrides(hid),
+		"Today":     time.Now(),
+	}
+	if errKey := r.URL.Query().Get("err"); errKey != "" {
+		if _, ok := translations["en"][errKey]; ok {
+			data["Error"] = errKey
+		}
+	}
+	render(w, r, "rates.html", data)
+}
+
+// adminRatesHandler shows the rate providers and manages the manual rates,
+// which are shared by all households.
+func adminRatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		cur := strings.ToUpper(strings.TrimSpace(r.FormValue("currency")))
+		var err error
+		switch r.FormValue("action") {
+		case "set":
+			rate, perr := strconv.ParseFloat(r.FormValue("rate"), 64)
+			if len(cur) == 3 && perr == nil && rate > 0 {
+				_, err = db.Exec("INSERT INTO manual_rates (currency, rate, updated_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE rate=VALUES(rate), updated_at=VALUES(updated_at)", cur, rate, time.Now())
+			}
+		case "delete":
+			_, err = db.Exec("DELETE FROM manual_rates WHERE currency=?", cur)
+		}
+		if err != nil {
+			http.Redirect(w, r, "/famoney/admin/rates?err="+errorKey(err), http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/famoney/admin/rates", http.StatusSeeOther)
+		return
+	}
+	type manualRate struct {
+		Currency  string
+		Rate      float64
+		UpdatedAt time.Time
+	}
+	rows, _ := db.Query("SELECT currency, rate, updated_at FROM manual_rates ORDER BY currency")
+	manual := []*manualRate{}
+	for rows.Next() {
+		m := &manualRate{}
+		if err := rows.Scan(&m.Currency, &m.Rate, &m.UpdatedAt); err == nil {
+			manual = append(manual, m)
+		}
+	}
+	ratesMu.RLock()
+	source, updated := ratesSource, ratesUpdated
+	ratesMu.RUnlock()
+	data := map[string]interface{}{
+		"ManualRates":  manual,
+		"Providers":    rateProviders.Name(),
+		"RatesSource":  source,
+		"RatesUpdated": updated,
+	}
+	if errKey := r.URL.Query().Get("err"); errKey != "" {
+		if _, ok := translations["en"][errKey]; ok {
+			data["Error"] = errKey
+		}
+	}
+	render(w, r, "admin_rates.html", data)
+}
+
+// formDate parses an optional YYYY-MM-DD form field, returning nil when it
+// is empty or invalid so it can be stored as NULL.
+func formDate(r *http.Request, key string) *time.Time {
+	t, err := time.Parse("2006-01-02", r.FormValue(key))
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+func integrityHandler(w http.ResponseWriter, r *http.Request) {
+	uid := currentUser(r)
+	if r.Method == "POST" {
+		mode := r.FormValue("mode")
+		wid, _ := strconv.Atoi(r.FormValue("wallet"))
+		cur := r.FormValue("currency")
+		issues, err := checkBalances()
+		for _, i := range issues {
+			if err != nil {
+				break
+			}
+			if wid == 0 || i.WalletID == wid && i.Currency == cur {
+				err = repairBalance(uid, i.WalletID, i.Currency, mode)
+			}
+		}
+		if err != nil {
+			http.Redirect(w, r, "/famoney/admin/integrity?err="+errorKey(err), http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/famoney/admin/integrity", http.StatusSeeOther)
+		return
+	}
+	issues, err := checkBalances()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := map[string]interface{}{
+		"Issues": issues,
+	}
+	if errKey := r.URL.Query().Get("err"); errKey != "" {
+		if _, ok := translations["en"][errKey]; ok {
+			data["Error"] = errKey
+		}
+	}
+	render(w, r, "integrity.html", data)
 }
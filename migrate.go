@@ -0,0 +1,172 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Schema changes live in migrations/NNNN_name.sql and are compiled into
+// the binary. Each file is applied once, in version order, and recorded in
+// schema_version. MySQL cannot roll back DDL, so statements are written to
+// be safe to repeat and errors saying an object already exists are ignored;
+// this is also how databases created from the old init_db.sql adopt the
+// migrations.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+// MySQL errors meaning the change is already in place.
+var alreadyApplied = map[uint16]bool{
+	1050: true, // table exists
+	1060: true, // duplicate column
+	1061: true, // duplicate key name
+	1091: true, // dropped key or column does not exist
+	1826: true, // duplicate foreign key constraint
+}
+
+func loadMigrations() ([]*migration, error) {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	list := []*migration{}
+	seen := map[int]string{}
+	for _, path := range names {
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "migrations/"), ".sql")
+		num, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: name must start with a version number", path)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, name, version)
+		}
+		seen[version] = name
+		body, err := migrationFiles.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, &migration{Version: version, Name: name, Statements: splitStatements(string(body))})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+// splitStatements breaks a migration into statements at lines ending in a
+// semicolon, dropping "--" comment lines.
+func splitStatements(body string) []string {
+	stmts := []string{}
+	var cur []string
+	for _, line := range strings.Split(body, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		cur = append(cur, line)
+		if strings.HasSuffix(trimmed, ";") {
+			stmt := strings.TrimSuffix(strings.TrimSpace(strings.Join(cur, "\n")), ";")
+			stmts = append(stmts, stmt)
+			cur = nil
+		}
+	}
+	if len(cur) > 0 {
+		stmts = append(stmts, strings.TrimSpace(strings.Join(cur, "\n")))
+	}
+	return stmts
+}
+
+// appliedVersions reads schema_version. A missing table means nothing has
+// been applied yet.
+func appliedVersions() (map[int]bool, error) {
+	applied := map[int]bool{}
+	rows, err := db.Query("SELECT version FROM schema_version")
+	if err != nil {
+		var me *mysql.MySQLError
+		if errors.As(err, &me) && me.Number == 1146 {
+			return applied, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+// migrateDB applies all pending migrations. With dryRun it only logs what
+// would be executed and leaves the database untouched.
+func migrateDB(dryRun bool) error {
+	list, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := appliedVersions()
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INT PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at DATETIME NOT NULL)"); err != nil {
+			return err
+		}
+	}
+	pending := 0
+	for _, m := range list {
+		if applied[m.Version] {
+			continue
+		}
+		pending++
+		if dryRun {
+			log.Printf("pending migration %s", m.Name)
+			for _, stmt := range m.Statements {
+				log.Printf("  %s;", stmt)
+			}
+			continue
+		}
+		log.Printf("applying migration %s", m.Name)
+		for _, stmt := range m.Statements {
+			if _, err := db.Exec(stmt); err != nil {
+				var me *mysql.MySQLError
+				if errors.As(err, &me) && alreadyApplied[me.Number] {
+					continue
+				}
+				return fmt.Errorf("migration %s: %v", m.Name, err)
+			}
+		}
+		if _, err := db.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", m.Version, m.Name, time.Now()); err != nil {
+			return err
+		}
+	}
+	if pending == 0 {
+		log.Printf("schema is up to date (version %d)", list[len(list)-1].Version)
+	}
+	return nil
+}
+
+// runMigrate implements the "migrate" subcommand.
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print pending migrations without applying them")
+	flags.Parse(args)
+	return migrateDB(*dryRun)
+}
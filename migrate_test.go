@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var (
+	addUniqueRe = regexp.MustCompile(`(?i)^ALTER TABLE categories ADD UNIQUE INDEX (\w+) \(([^)]*)\)`)
+	dropIndexRe = regexp.MustCompile(`(?i)^ALTER TABLE categories DROP INDEX (\w+)`)
+)
+
+// categoryKeys replays the migrations' changes to the unique indexes of
+// categories and returns the columns of each remaining index.
+func categoryKeys(t *testing.T) map[string][]string {
+	list, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string][]string{}
+	for _, m := range list {
+		for _, stmt := range m.Statements {
+			if strings.Contains(stmt, "CREATE TABLE IF NOT EXISTS categories") && strings.Contains(stmt, "name VARCHAR(255) UNIQUE") {
+				keys["name"] = []string{"name"}
+			}
+			if g := addUniqueRe.FindStringSubmatch(stmt); g != nil {
+				cols := strings.Split(g[2], ",")
+				for i := range cols {
+					cols[i] = strings.TrimSpace(cols[i])
+				}
+				keys[g[1]] = cols
+			}
+			if g := dropIndexRe.FindStringSubmatch(stmt); g != nil {
+				if _, ok := keys[g[1]]; !ok {
+					t.Errorf("migration %s drops unknown index %s", m.Name, g[1])
+				}
+				delete(keys, g[1])
+			}
+		}
+	}
+	return keys
+}
+
+func TestCategoryNamesUniqueAmongSiblings(t *testing.T) {
+	keys := categoryKeys(t)
+	type row map[string]string
+	// parent_key is the generated IFNULL(parent_id, 0) column of 0018.
+	clash := func(a, b row) bool {
+		for _, cols := range keys {
+			same := true
+			for _, c := range cols {
+				same = same && a[c] == b[c]
+			}
+			if same {
+				return true
+			}
+		}
+		return false
+	}
+	food := row{"household_id": "1", "parent_key": "10", "name": "Other"}
+	transport := row{"household_id": "1", "parent_key": "20", "name": "Other"}
+	if clash(food, transport) {
+		t.Errorf("Food / Other and Transport / Other clash under keys %v", keys)
+	}
+	if !clash(food, row{"household_id": "1", "parent_key": "10", "name": "Other"}) {
+		t.Errorf("two Food / Other subcategories do not clash under keys %v", keys)
+	}
+	top := row{"household_id": "1", "parent_key": "0", "name": "Food"}
+	if !clash(top, row{"household_id": "1", "parent_key": "0", "name": "Food"}) {
+		t.Errorf("two top-level Food categories do not clash under keys %v", keys)
+	}
+	if clash(top, row{"household_id": "2", "parent_key": "0", "name": "Food"}) {
+		t.Errorf("households cannot both have a Food category under keys %v", keys)
+	}
+	if got := fmt.Sprint(keys["idx_categories_sibling_name"]); got != "[household_id parent_key name]" {
+		t.Errorf("idx_categories_sibling_name = %s", got)
+	}
+}
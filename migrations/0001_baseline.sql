@@ -1,16 +1,18 @@
-CREATE TABLE users (
+-- Schema of the first release. Existing databases already have these
+-- tables and only record the version.
+CREATE TABLE IF NOT EXISTS users (
   id INT AUTO_INCREMENT PRIMARY KEY,
   username VARCHAR(255) UNIQUE,
   password VARCHAR(255)
 );
 
-CREATE TABLE wallets (
+CREATE TABLE IF NOT EXISTS wallets (
   id INT AUTO_INCREMENT PRIMARY KEY,
   name VARCHAR(255),
   color VARCHAR(7) DEFAULT '#b5651d'
 );
 
-CREATE TABLE wallet_balances (
+CREATE TABLE IF NOT EXISTS wallet_balances (
   wallet_id INT,
   currency VARCHAR(3),
   balance DOUBLE,
@@ -18,7 +20,7 @@ CREATE TABLE wallet_balances (
   FOREIGN KEY (wallet_id) REFERENCES wallets(id)
 );
 
-CREATE TABLE wallet_owners (
+CREATE TABLE IF NOT EXISTS wallet_owners (
   wallet_id INT,
   user_id INT,
   display_order INT DEFAULT 0,
@@ -27,12 +29,12 @@ CREATE TABLE wallet_owners (
   FOREIGN KEY (user_id) REFERENCES users(id)
 );
 
-CREATE TABLE categories (
+CREATE TABLE IF NOT EXISTS categories (
   id INT AUTO_INCREMENT PRIMARY KEY,
   name VARCHAR(255) UNIQUE
 );
 
-CREATE TABLE flows (
+CREATE TABLE IF NOT EXISTS flows (
   id INT AUTO_INCREMENT PRIMARY KEY,
   wallet_id INT,
   amount DOUBLE,
@@ -0,0 +1,6 @@
+-- The code has always recorded who booked a flow, but the original
+-- init_db.sql never created the column. Flows without an operator are
+-- attributed to the wallet's first owner.
+ALTER TABLE flows ADD COLUMN operator_id INT NULL;
+
+UPDATE flows f SET operator_id=(SELECT MIN(o.user_id) FROM wallet_owners o WHERE o.wallet_id=f.wallet_id) WHERE operator_id IS NULL;
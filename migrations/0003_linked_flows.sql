@@ -0,0 +1,8 @@
+-- Transfers and currency exchanges are stored as linked pairs of flows.
+ALTER TABLE flows ADD COLUMN kind VARCHAR(16) NOT NULL DEFAULT 'normal';
+
+ALTER TABLE flows ADD COLUMN linked_flow_id INT NULL;
+
+ALTER TABLE flows ADD COLUMN rate DOUBLE NULL;
+
+ALTER TABLE flows ADD COLUMN market_rate DOUBLE NULL;
@@ -0,0 +1,10 @@
+-- Dated exchange rates and the per-flow rate snapshot used for
+-- transaction-date valuation.
+CREATE TABLE IF NOT EXISTS exchange_rates (
+  rate_date DATE,
+  currency VARCHAR(3),
+  rate DOUBLE,
+  PRIMARY KEY (rate_date, currency)
+);
+
+ALTER TABLE flows ADD COLUMN usd_rate DOUBLE NULL;
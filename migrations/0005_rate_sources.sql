@@ -0,0 +1,17 @@
+-- Hand-maintained rates for the manual provider and household overrides.
+CREATE TABLE IF NOT EXISTS manual_rates (
+  currency VARCHAR(3) PRIMARY KEY,
+  rate DOUBLE NOT NULL,
+  updated_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS rate_overrides (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  household_id INT NOT NULL DEFAULT 0,
+  from_currency VARCHAR(3) NOT NULL,
+  to_currency VARCHAR(3) NOT NULL,
+  rate DOUBLE NOT NULL,
+  valid_from DATE NULL,
+  valid_to DATE NULL,
+  note VARCHAR(255)
+);
@@ -0,0 +1,39 @@
+-- Amounts move from DOUBLE major units to BIGINT minor units using the
+-- ISO 4217 precision of each currency (see currencyDigits in money.go).
+-- The converted values are first collected in a scratch column, so the
+-- scaling happens exactly once even if the migration is interrupted and
+-- run again, and the type only changes once every row has been converted.
+-- Columns that are already BIGINT are copied unchanged.
+ALTER TABLE flows ADD COLUMN amount_minor BIGINT NULL;
+
+UPDATE flows SET amount_minor=IF((SELECT DATA_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME='flows' AND COLUMN_NAME='amount')='double',
+    ROUND(IFNULL(amount, 0) * CASE
+      WHEN currency IN ('BIF','CLP','DJF','GNF','ISK','JPY','KMF','KRW','PYG','RWF','UGX','UYI','VND','VUV','XAF','XOF','XPF') THEN 1
+      WHEN currency IN ('BHD','IQD','JOD','KWD','LYD','OMR','TND') THEN 1000
+      WHEN currency IN ('CLF','UYW') THEN 10000
+      ELSE 100 END),
+    IFNULL(amount, 0))
+  WHERE amount_minor IS NULL;
+
+UPDATE flows SET amount=amount_minor;
+
+ALTER TABLE flows MODIFY amount BIGINT NOT NULL;
+
+ALTER TABLE flows DROP COLUMN amount_minor;
+
+ALTER TABLE wallet_balances ADD COLUMN balance_minor BIGINT NULL;
+
+UPDATE wallet_balances SET balance_minor=IF((SELECT DATA_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME='wallet_balances' AND COLUMN_NAME='balance')='double',
+    ROUND(IFNULL(balance, 0) * CASE
+      WHEN currency IN ('BIF','CLP','DJF','GNF','ISK','JPY','KMF','KRW','PYG','RWF','UGX','UYI','VND','VUV','XAF','XOF','XPF') THEN 1
+      WHEN currency IN ('BHD','IQD','JOD','KWD','LYD','OMR','TND') THEN 1000
+      WHEN currency IN ('CLF','UYW') THEN 10000
+      ELSE 100 END),
+    IFNULL(balance, 0))
+  WHERE balance_minor IS NULL;
+
+UPDATE wallet_balances SET balance=balance_minor;
+
+ALTER TABLE wallet_balances MODIFY balance BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE wallet_balances DROP COLUMN balance_minor;
@@ -0,0 +1,9 @@
+-- Login sessions, so that restarts do not log everyone out.
+CREATE TABLE IF NOT EXISTS sessions (
+  id VARCHAR(64) PRIMARY KEY,
+  user_id INT NOT NULL,
+  created_at DATETIME NOT NULL,
+  last_seen DATETIME NOT NULL,
+  INDEX idx_sessions_user (user_id),
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
@@ -0,0 +1,4 @@
+-- Device details shown on the sessions page.
+ALTER TABLE sessions ADD COLUMN user_agent VARCHAR(255) NULL;
+
+ALTER TABLE sessions ADD COLUMN ip VARCHAR(64) NULL;
@@ -0,0 +1,2 @@
+-- Synchronizer token checked on every state-changing request.
+ALTER TABLE sessions ADD COLUMN csrf_token VARCHAR(64) NULL;
@@ -0,0 +1,10 @@
+-- Audit trail of failed and throttled logins.
+CREATE TABLE IF NOT EXISTS login_failures (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  username VARCHAR(255),
+  ip VARCHAR(64),
+  user_agent VARCHAR(255),
+  reason VARCHAR(16) NOT NULL,
+  attempted_at DATETIME NOT NULL,
+  INDEX idx_login_failures_time (attempted_at)
+);
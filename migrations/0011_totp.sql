@@ -0,0 +1,15 @@
+-- Optional TOTP second factor with hashed one-time recovery codes.
+ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64) NULL;
+
+ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT 0;
+
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NULL;
+
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  user_id INT NOT NULL,
+  code_hash CHAR(64) NOT NULL,
+  used_at DATETIME NULL,
+  INDEX idx_recovery_user (user_id),
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
@@ -0,0 +1,11 @@
+-- Passkeys. data holds the credential as serialized by go-webauthn.
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  user_id INT NOT NULL,
+  credential_id VARCHAR(255) NOT NULL UNIQUE,
+  name VARCHAR(100) NOT NULL,
+  data TEXT NOT NULL,
+  created_at DATETIME NOT NULL,
+  last_used_at DATETIME NULL,
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
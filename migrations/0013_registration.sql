@@ -0,0 +1,19 @@
+-- Registration modes: accounts awaiting approval and single-use invites.
+ALTER TABLE users ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'active';
+
+ALTER TABLE users ADD COLUMN created_at DATETIME NULL;
+
+CREATE TABLE IF NOT EXISTS invites (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  code_hash CHAR(64) NOT NULL UNIQUE,
+  note VARCHAR(255) NOT NULL DEFAULT '',
+  wallet_id INT NULL,
+  created_by INT NOT NULL,
+  created_at DATETIME NOT NULL,
+  expires_at DATETIME NULL,
+  used_by INT NULL,
+  used_at DATETIME NULL,
+  FOREIGN KEY (wallet_id) REFERENCES wallets(id) ON DELETE SET NULL,
+  FOREIGN KEY (created_by) REFERENCES users(id),
+  FOREIGN KEY (used_by) REFERENCES users(id)
+);
@@ -0,0 +1,52 @@
+-- Households separate the data of different families. Wallets and
+-- categories belong to one household, and users can be members of several.
+-- Existing installations were used by a single family, so all current
+-- users, wallets, categories and rate overrides are put into one household.
+CREATE TABLE IF NOT EXISTS households (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  name VARCHAR(255) NOT NULL,
+  created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS household_members (
+  household_id INT NOT NULL,
+  user_id INT NOT NULL,
+  joined_at DATETIME NOT NULL,
+  PRIMARY KEY (household_id, user_id),
+  FOREIGN KEY (household_id) REFERENCES households(id),
+  FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+ALTER TABLE wallets ADD COLUMN household_id INT NULL;
+
+ALTER TABLE wallets ADD CONSTRAINT fk_wallets_household FOREIGN KEY (household_id) REFERENCES households(id);
+
+ALTER TABLE categories ADD COLUMN household_id INT NULL;
+
+ALTER TABLE categories ADD CONSTRAINT fk_categories_household FOREIGN KEY (household_id) REFERENCES households(id);
+
+ALTER TABLE categories ADD UNIQUE INDEX idx_categories_household_name (household_id, name);
+
+ALTER TABLE categories DROP INDEX name;
+
+ALTER TABLE invites ADD COLUMN household_id INT NULL;
+
+ALTER TABLE invites ADD CONSTRAINT fk_invites_household FOREIGN KEY (household_id) REFERENCES households(id) ON DELETE SET NULL;
+
+INSERT INTO households (name, created_at)
+  SELECT 'FaMoney', NOW() FROM DUAL
+  WHERE EXISTS (SELECT 1 FROM users) AND NOT EXISTS (SELECT 1 FROM households);
+
+INSERT IGNORE INTO household_members (household_id, user_id, joined_at)
+  SELECT h.id, u.id, NOW() FROM households h JOIN users u
+  WHERE h.id = (SELECT MIN(id) FROM households);
+
+UPDATE wallets SET household_id = (SELECT MIN(id) FROM households) WHERE household_id IS NULL;
+
+UPDATE categories SET household_id = (SELECT MIN(id) FROM households) WHERE household_id IS NULL;
+
+UPDATE rate_overrides SET household_id = (SELECT MIN(id) FROM households) WHERE household_id = 0 AND EXISTS (SELECT 1 FROM households);
+
+DELETE FROM rate_overrides WHERE household_id = 0;
+
+ALTER TABLE rate_overrides ADD CONSTRAINT fk_rate_overrides_household FOREIGN KEY (household_id) REFERENCES households(id);
@@ -0,0 +1,3 @@
+-- Roles of the users a wallet is shared with (see roles.go). Everyone who
+-- had access so far had full control, so existing rows become owners.
+ALTER TABLE wallet_owners ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'owner';
@@ -0,0 +1,3 @@
+-- Administrators granted from the admin console, in addition to the
+-- usernames listed in FAMONEY_ADMINS.
+ALTER TABLE users ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT 0;
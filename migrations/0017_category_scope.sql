@@ -0,0 +1,8 @@
+-- Flows may only use categories of their wallet's household. Clear any
+-- reference that crosses households, which the backfill into a single
+-- household cannot have produced but manual edits might.
+UPDATE flows f
+  JOIN wallets w ON f.wallet_id = w.id
+  JOIN categories c ON f.category_id = c.id
+  SET f.category_id = NULL
+  WHERE NOT (c.household_id <=> w.household_id);
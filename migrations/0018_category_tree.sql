@@ -0,0 +1,14 @@
+-- Categories can be nested under a parent category of the same household.
+ALTER TABLE categories ADD COLUMN parent_id INT NULL;
+
+ALTER TABLE categories ADD CONSTRAINT fk_categories_parent FOREIGN KEY (parent_id) REFERENCES categories(id);
+
+-- Names only need to differ among siblings, so "Food / Other" and
+-- "Transport / Other" can both exist. parent_key stands in for parent_id in
+-- the key because NULL never collides in a unique index, which would let
+-- top-level categories share a name.
+ALTER TABLE categories ADD COLUMN parent_key INT AS (IFNULL(parent_id, 0)) STORED;
+
+ALTER TABLE categories ADD UNIQUE INDEX idx_categories_sibling_name (household_id, parent_key, name);
+
+ALTER TABLE categories DROP INDEX idx_categories_household_name;
@@ -0,0 +1,19 @@
+-- Categories are income, expense, transfer or adjustment categories and
+-- the kind decides the sign of new flows. Categories that so far only
+-- received money become income categories, all others expense categories.
+ALTER TABLE categories ADD COLUMN kind VARCHAR(16) NOT NULL DEFAULT 'expense';
+
+UPDATE categories c SET kind = 'income'
+  WHERE EXISTS (SELECT 1 FROM flows f WHERE f.category_id = c.id AND f.kind = 'normal')
+    AND NOT EXISTS (SELECT 1 FROM flows f WHERE f.category_id = c.id AND f.kind = 'normal' AND f.amount < 0);
+
+-- Subcategories take the kind of their top-level category.
+UPDATE categories c JOIN (
+  WITH RECURSIVE tree (id, kind) AS (
+    SELECT id, kind FROM categories WHERE parent_id IS NULL
+    UNION ALL
+    SELECT ch.id, tree.kind FROM categories ch JOIN tree ON ch.parent_id = tree.id
+  )
+  SELECT id, kind FROM tree
+) t ON c.id = t.id
+SET c.kind = t.kind;
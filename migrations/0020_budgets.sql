@@ -0,0 +1,24 @@
+-- Budgets per category and period, optionally limited to some wallets.
+-- Amounts are in minor units of the budget's currency.
+CREATE TABLE IF NOT EXISTS budgets (
+  id INT AUTO_INCREMENT PRIMARY KEY,
+  household_id INT NOT NULL,
+  category_id INT NOT NULL,
+  period VARCHAR(16) NOT NULL,
+  amount BIGINT NOT NULL,
+  currency VARCHAR(3) NOT NULL,
+  rollover BOOLEAN NOT NULL DEFAULT 0,
+  starts_on DATE NOT NULL,
+  created_by INT NULL,
+  FOREIGN KEY (household_id) REFERENCES households(id),
+  FOREIGN KEY (category_id) REFERENCES categories(id),
+  FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS budget_wallets (
+  budget_id INT NOT NULL,
+  wallet_id INT NOT NULL,
+  PRIMARY KEY (budget_id, wallet_id),
+  FOREIGN KEY (budget_id) REFERENCES budgets(id),
+  FOREIGN KEY (wallet_id) REFERENCES wallets(id)
+);
@@ -0,0 +1,11 @@
+-- Users invited to a household join it only once they accept.
+CREATE TABLE IF NOT EXISTS household_invites (
+  household_id INT NOT NULL,
+  user_id INT NOT NULL,
+  invited_by INT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY (household_id, user_id),
+  FOREIGN KEY (household_id) REFERENCES households(id),
+  FOREIGN KEY (user_id) REFERENCES users(id),
+  FOREIGN KEY (invited_by) REFERENCES users(id) ON DELETE SET NULL
+);
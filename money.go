@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money amounts are stored as int64 counts of the currency's minor unit
+// (cents for CNY and USD, yen for JPY, fils for KWD) so that balances never
+// drift. Conversions between currencies still go through float64 rates and
+// are rounded back to minor units.
+
+// currencyDigits lists ISO 4217 minor-unit exponents that differ from the
+// default of two.
+var currencyDigits = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0,
+	"KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0,
+	"XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+var (
+	errMoneyFormat = errors.New("invalid money amount")
+	errCurrency    = errors.New("ErrCurrency")
+)
+
+func minorDigits(cur string) int {
+	if d, ok := currencyDigits[cur]; ok {
+		return d
+	}
+	return 2
+}
+
+func minorScale(cur string) float64 {
+	return math.Pow10(minorDigits(cur))
+}
+
+// parseMoney parses a decimal amount typed into a form, such as "-12.5",
+// into minor units of cur. It rejects anything but an optional sign,
+// digits and at most as many decimals as the currency allows.
+func parseMoney(s, cur string) (int64, error) {
+	s = strings.TrimSpace(s)
+	neg := false
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	intPart, frac, hasDot := strings.Cut(s, ".")
+	digits := minorDigits(cur)
+	if intPart == "" && frac == "" || hasDot && frac == "" || len(frac) > digits {
+		return 0, errMoneyFormat
+	}
+	for _, part := range []string{intPart, frac} {
+		for _, r := range part {
+			if r < '0' || r > '9' {
+				return 0, errMoneyFormat
+			}
+		}
+	}
+	frac += strings.Repeat("0", digits-len(frac))
+	if intPart == "" {
+		intPart = "0"
+	}
+	v, err := strconv.ParseInt(intPart+frac, 10, 64)
+	if err != nil {
+		return 0, errMoneyFormat
+	}
+	if neg {
+		v = -v
+	}
+	return v, nil
+}
+
+// moneyString renders minor units as a plain decimal with the currency's
+// precision, suitable for form values.
+func moneyString(amount int64, cur string) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	s := strconv.FormatInt(amount, 10)
+	digits := minorDigits(cur)
+	if digits == 0 {
+		return sign + s
+	}
+	if len(s) <= digits {
+		s = strings.Repeat("0", digits-len(s)+1) + s
+	}
+	return sign + s[:len(s)-digits] + "." + s[len(s)-digits:]
+}
+
+// formatMoney renders minor units with thousands separators and the
+// currency's precision.
+func formatMoney(amount int64, cur string) string {
+	s := moneyString(amount, cur)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign = "-"
+		s = s[1:]
+	}
+	intPart, fracPart, hasFrac := strings.Cut(s, ".")
+	n := len(intPart)
+	var b strings.Builder
+	for i, r := range intPart {
+		if i != 0 && (n-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(r)
+	}
+	if hasFrac {
+		return sign + b.String() + "." + fracPart
+	}
+	return sign + b.String()
+}
+
+// toMajor converts minor units to a float amount for rate arithmetic.
+func toMajor(amount int64, cur string) float64 {
+	return float64(amount) / minorScale(cur)
+}
+
+// fromMajor rounds a float amount to the nearest minor unit of cur.
+func fromMajor(amount float64, cur string) int64 {
+	return int64(math.Round(amount * minorScale(cur)))
+}
+
+// convertMoney converts minor units of one currency into minor units of
+// another at today's rates for household hid.
+func convertMoney(hid int, amount int64, from, to string) int64 {
+	return fromMajor(convert(hid, toMajor(amount, from), from, to), to)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// RateOverride fixes the rate between two currencies, optionally only
+// within a date range: one unit of From is worth Rate units of To. Overrides
+// belong to a household and win over fetched market rates in every
+// conversion made for it.
+type RateOverride struct {
+	ID          int
+	HouseholdID int
+	From        string
+	To          string
+	Rate        float64
+	ValidFrom   *time.Time
+	ValidTo     *time.Time
+	Note        string
+}
+
+// ActiveOn reports whether the override applies on day. Both bounds are
+// inclusive; a missing bound is open-ended.
+func (o *RateOverride) ActiveOn(day time.Time) bool {
+	d := day.Format("2006-01-02")
+	if o.ValidFrom != nil && d < o.ValidFrom.Format("2006-01-02") {
+		return false
+	}
+	if o.ValidTo != nil && d > o.ValidTo.Format("2006-01-02") {
+		return false
+	}
+	return true
+}
+
+var (
+	overridesMu   sync.RWMutex
+	rateOverrides []*RateOverride
+)
+
+// loadRateOverrides reads the overrides of all households into memory. It
+// is called at startup and after every change on the rates page.
+func loadRateOverrides() {
+	rows, err := db.Query("SELECT id, household_id, from_currency, to_currency, rate, valid_from, valid_to, IFNULL(note, '') FROM rate_overrides ORDER BY id")
+	if err != nil {
+		log.Println("failed to load rate overrides", err)
+		return
+	}
+	defer rows.Close()
+	list := []*RateOverride{}
+	for rows.Next() {
+		o := &RateOverride{}
+		if err := rows.Scan(&o.ID, &o.HouseholdID, &o.From, &o.To, &o.Rate, &o.ValidFrom, &o.ValidTo, &o.Note); err == nil {
+			list = append(list, o)
+		}
+	}
+	overridesMu.Lock()
+	rateOverrides = list
+	overridesMu.Unlock()
+}
+
+// householdOverrides returns all overrides of hid.
+func householdOverrides(hid int) []*RateOverride {
+	overridesMu.RLock()
+	defer overridesMu.RUnlock()
+	list := []*RateOverride{}
+	for _, o := range rateOverrides {
+		if o.HouseholdID == hid {
+			list = append(list, o)
+		}
+	}
+	return list
+}
+
+// overridesOn returns the overrides of hid in effect on day.
+func overridesOn(hid int, day time.Time) []*RateOverride {
+	active := []*RateOverride{}
+	for _, o := range householdOverrides(hid) {
+		if o.ActiveOn(day) {
+			active = append(active, o)
+		}
+	}
+	return active
+}
+
+// hasOverride reports whether any override of hid in effect on day
+// involves one of the given currencies.
+func hasOverride(hid int, day time.Time, curs ...string) bool {
+	for _, o := range overridesOn(hid, day) {
+		for _, c := range curs {
+			if o.From == c || o.To == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addOverride stores an override for hid, which uid must be a member of.
+func addOverride(uid int, o *RateOverride) error {
+	if !isMember(uid, o.HouseholdID) {
+		return errNotMember
+	}
+	if _, err := db.Exec("INSERT INTO rate_overrides (household_id, from_currency, to_currency, rate, valid_from, valid_to, note) VALUES (?, ?, ?, ?, ?, ?, ?)", o.HouseholdID, o.From, o.To, o.Rate, o.ValidFrom, o.ValidTo, o.Note); err != nil {
+		return err
+	}
+	loadRateOverrides()
+	return nil
+}
+
+// deleteOverride removes an override of a household uid is a member of.
+func deleteOverride(uid, id int) error {
+	var hid int
+	db.QueryRow("SELECT household_id FROM rate_overrides WHERE id=?", id).Scan(&hid)
+	if hid == 0 || !isMember(uid, hid) {
+		return errNotMember
+	}
+	if _, err := db.Exec("DELETE FROM rate_overrides WHERE id=?", id); err != nil {
+		return err
+	}
+	loadRateOverrides()
+	return nil
+}
+
+// convertWith converts between currencies, preferring an override for the
+// exact pair, then an override for either side combined with the market
+// rate, and finally the market rates alone.
+func convertWith(rates map[string]float64, overrides []*RateOverride, amount float64, from, to string) float64 {
+	if from == to {
+		return amount
+	}
+	for _, o := range overrides {
+		switch {
+		case o.From == from && o.To == to:
+			return amount * o.Rate
+		case o.From == to && o.To == from:
+			return amount / o.Rate
+		}
+	}
+	for _, o := range overrides {
+		switch {
+		case o.From == from:
+			return marketConvert(rates, amount*o.Rate, o.To, to)
+		case o.To == from:
+			return marketConvert(rates, amount/o.Rate, o.From, to)
+		case o.To == to:
+			return marketConvert(rates, amount, from, o.From) * o.Rate
+		case o.From == to:
+			return marketConvert(rates, amount, from, o.To) / o.Rate
+		}
+	}
+	return marketConvert(rates, amount, from, to)
+}
+
+// marketConvert converts with a rate set, falling back to today's rates
+// when either currency is missing and to the unchanged amount when no rate
+// is known at all.
+func marketConvert(rates map[string]float64, amount float64, from, to string) float64 {
+	rateFrom, okFrom := rates[from]
+	rateTo, okTo := rates[to]
+	if !okFrom || !okTo {
+		current := getRates()
+		rateFrom, okFrom = current[from]
+		rateTo, okTo = current[to]
+	}
+	if !okFrom || !okTo {
+		return amount
+	}
+	usd := amount / rateFrom
+	return usd * rateTo
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Passkeys let users sign in with a WebAuthn credential instead of their
+// password. Credentials are discoverable, so the login page does not ask
+// for a username, and user verification (fingerprint, face or device PIN)
+// is required, so a passkey login skips the TOTP step.
+//
+// A login whose signature counter did not increase is refused, as the
+// passkey may have been copied; authenticators that do not count always
+// send zero and are not affected.
+//
+// WEBAUTHN_RP_ID is the host name the passkeys are bound to and
+// WEBAUTHN_ORIGIN the URL the browser shows; both default to the local
+// development address.
+
+var errPasskey = errors.New("ErrPasskey")
+
+var relyingParty = func() *webauthn.WebAuthn {
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		rpID = "localhost"
+	}
+	origin := os.Getenv("WEBAUTHN_ORIGIN")
+	if origin == "" {
+		origin = "http://localhost:8295"
+	}
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: "FaMoney",
+		RPOrigins:     []string{origin},
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTTL, TimeoutUVD: ceremonyTTL},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTTL, TimeoutUVD: ceremonyTTL},
+		},
+	})
+	if err != nil {
+		log.Println("passkeys disabled:", err)
+		return nil
+	}
+	return wa
+}()
+
+// Passkey is a stored credential as shown on the passkeys page.
+type Passkey struct {
+	ID         int
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// passkeyUser adapts a user to webauthn.User. The user handle is the
+// decimal user id.
+type passkeyUser struct {
+	id          int
+	name        string
+	credentials []webauthn.Credential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte                         { return []byte(strconv.Itoa(u.id)) }
+func (u *passkeyUser) WebAuthnName() string                       { return u.name }
+func (u *passkeyUser) WebAuthnDisplayName() string                { return u.name }
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+func loadPasskeyUser(uid int) (*passkeyUser, error) {
+	u := &passkeyUser{id: uid}
+	if err := db.QueryRow("SELECT username FROM users WHERE id=?", uid).Scan(&u.name); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT data FROM webauthn_credentials WHERE user_id=?", uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var c webauthn.Credential
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, err
+		}
+		u.credentials = append(u.credentials, c)
+	}
+	return u, rows.Err()
+}
+
+func credentialKey(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+func listPasskeys(uid int) ([]*Passkey, error) {
+	rows, err := db.Query("SELECT id, name, created_at, last_used_at FROM webauthn_credentials WHERE user_id=? ORDER BY created_at", uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*Passkey{}
+	for rows.Next() {
+		p := &Passkey{}
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &p.LastUsedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+func savePasskey(uid int, name string, c *webauthn.Credential) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = "Passkey"
+	}
+	_, err = db.Exec("INSERT INTO webauthn_credentials (user_id, credential_id, name, data, created_at) VALUES (?, ?, ?, ?, ?)", uid, credentialKey(c.ID), name, data, time.Now())
+	return err
+}
+
+// touchPasskey stores the updated signature counter after a login.
+func touchPasskey(c *webauthn.Credential) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE webauthn_credentials SET data=?, last_used_at=? WHERE credential_id=?", data, time.Now(), credentialKey(c.ID))
+	return err
+}
+
+// ceremony is the server side of a registration or login in progress.
+type ceremony struct {
+	UserID int
+	Data   *webauthn.SessionData
+}
+
+const (
+	ceremonyCookie = "webauthn_ceremony"
+	ceremonyTTL    = 5 * time.Minute
+)
+
+var (
+	ceremoniesMu sync.Mutex
+	ceremonies   = map[string]*ceremony{}
+)
+
+func startCeremony(w http.ResponseWriter, r *http.Request, uid int, data *webauthn.SessionData) error {
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	ceremoniesMu.Lock()
+	for k, c := range ceremonies {
+		if now.After(c.Data.Expires.Add(time.Minute)) {
+			delete(ceremonies, k)
+		}
+	}
+	ceremonies[id] = &ceremony{UserID: uid, Data: data}
+	ceremoniesMu.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: ceremonyCookie, Value: id, Path: "/famoney/", MaxAge: int(ceremonyTTL / time.Second), HttpOnly: true, Secure: secureCookies(r), SameSite: http.SameSiteStrictMode})
+	return nil
+}
+
+// takeCeremony returns and forgets the ceremony of this browser.
+func takeCeremony(r *http.Request) *ceremony {
+	cookie, err := r.Cookie(ceremonyCookie)
+	if err != nil {
+		return nil
+	}
+	ceremoniesMu.Lock()
+	defer ceremoniesMu.Unlock()
+	c, ok := ceremonies[cookie.Value]
+	delete(ceremonies, cookie.Value)
+	if !ok || time.Now().After(c.Data.Expires) {
+		return nil
+	}
+	return c
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// passkeyError answers a failed ceremony step with a translated message.
+func passkeyError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Println("passkey:", err)
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": T(getLang(w, r), errPasskey.Error())})
+}
+
+func passkeyRegisterBeginHandler(w http.ResponseWriter, r *http.Request) {
+	uid := currentUser(r)
+	if relyingParty == nil || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	u, err := loadPasskeyUser(uid)
+	if err != nil {
+		passkeyError(w, r, err)
+		return
+	}
+	creation, data, err := relyingParty.BeginRegistration(u,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(webauthn.Credentials(u.credentials).CredentialDescriptors()),
+	)
+	if err == nil {
+		err = startCeremony(w, r, uid, data)
+	}
+	if err != nil {
+		passkeyError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, creation)
+}
+
+func passkeyRegisterFinishHandler(w http.ResponseWriter, r *http.Request) {
+	uid := currentUser(r)
+	if relyingParty == nil || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	c := takeCeremony(r)
+	if c == nil || c.UserID != uid {
+		passkeyError(w, r, errors.New("no registration in progress"))
+		return
+	}
+	u, err := loadPasskeyUser(uid)
+	if err != nil {
+		passkeyError(w, r, err)
+		return
+	}
+	cred, err := relyingParty.FinishRegistration(u, *c.Data, r)
+	if err == nil {
+		err = savePasskey(uid, r.URL.Query().Get("name"), cred)
+	}
+	if err != nil {
+		passkeyError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": "/famoney/passkeys"})
+}
+
+func passkeyLoginBeginHandler(w http.ResponseWriter, r *http.Request) {
+	if relyingParty == nil || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	assertion, data, err := relyingParty.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err == nil {
+		err = startCeremony(w, r, 0, data)
+	}
+	if err != nil {
+		passkeyError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, assertion)
+}
+
+func passkeyLoginFinishHandler(w http.ResponseWriter, r *http.Request) {
+	if relyingParty == nil || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	c := takeCeremony(r)
+	if c == nil {
+		passkeyError(w, r, errors.New("no login in progress"))
+		return
+	}
+	var found *passkeyUser
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		uid, err := strconv.Atoi(string(userHandle))
+		if err != nil {
+			return nil, err
+		}
+		u, err := loadPasskeyUser(uid)
+		if err != nil {
+			return nil, err
+		}
+		found = u
+		return u, nil
+	}
+	cred, err := relyingParty.FinishDiscoverableLogin(handler, *c.Data, r)
+	if err == nil && cred.Authenticator.CloneWarning {
+		err = errors.New("signature counter did not increase")
+	}
+	if err == nil {
+		err = accountError(found.id)
+	}
+	if err == nil {
+		err = touchPasskey(cred)
+	}
+	if err != nil {
+		auditLoginFailure("", clientIP(r), r.UserAgent(), "passkey")
+		passkeyError(w, r, err)
+		return
+	}
+	s, err := sessions.Create(found.id, r.UserAgent(), clientIP(r))
+	if err != nil {
+		passkeyError(w, r, err)
+		return
+	}
+	setSessionCookie(w, r, s)
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": "/famoney/dashboard"})
+}
+
+func passkeysHandler(w http.ResponseWriter, r *http.Request) {
+	uid := currentUser(r)
+	if r.Method == "POST" {
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		var err error
+		switch r.FormValue("action") {
+		case "rename":
+			if name := r.FormValue("name"); name != "" {
+				_, err = db.Exec("UPDATE webauthn_credentials SET name=? WHERE id=? AND user_id=?", name, id, uid)
+			}
+		case "delete":
+			_, err = db.Exec("DELETE FROM webauthn_credentials WHERE id=? AND user_id=?", id, uid)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/famoney/passkeys", http.StatusSeeOther)
+		return
+	}
+	list, err := listPasskeys(uid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := map[string]interface{}{
+		"Passkeys": list,
+		"Enabled":  relyingParty != nil,
+	}
+	render(w, r, "passkeys.html", data)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// authenticator is a software passkey: an ES256 key pair with a
+// discoverable credential and a signature counter, producing the responses
+// a browser would send.
+type authenticator struct {
+	key    *ecdsa.PrivateKey
+	id     []byte
+	user   []byte
+	origin string
+	rpID   string
+	count  uint32
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 32)
+	rand.Read(id)
+	return &authenticator{key: key, id: id, origin: relyingParty.Config.RPOrigins[0], rpID: relyingParty.Config.RPID}
+}
+
+var b64 = base64.RawURLEncoding
+
+func (a *authenticator) clientData(typ string, challenge []byte) []byte {
+	data, _ := json.Marshal(map[string]string{"type": typ, "challenge": b64.EncodeToString(challenge), "origin": a.origin})
+	return data
+}
+
+// authData builds authenticator data with user presence and verification
+// set and, for registrations, the attested credential.
+func (a *authenticator) authData(attested []byte) []byte {
+	rpHash := sha256.Sum256([]byte(a.rpID))
+	flags := byte(protocol.FlagUserPresent | protocol.FlagUserVerified)
+	if attested != nil {
+		flags |= byte(protocol.FlagAttestedCredentialData)
+	}
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], a.count)
+	data := append(rpHash[:], flags)
+	data = append(data, count[:]...)
+	return append(data, attested...)
+}
+
+// create answers the options of a registration ceremony with a "none"
+// attestation.
+func (a *authenticator) create(t *testing.T, creation *protocol.CredentialCreation) []byte {
+	id, _ := creation.Response.User.ID.(string)
+	user, err := b64.DecodeString(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.user = user
+	pub, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{KeyType: int64(webauthncose.EllipticKey), Algorithm: int64(webauthncose.AlgES256)},
+		Curve:         1, // P-256
+		XCoord:        a.key.X.FillBytes(make([]byte, 32)),
+		YCoord:        a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attested := make([]byte, 16) // zero AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.id)))
+	attested = append(attested, a.id...)
+	attested = append(attested, pub...)
+	object, err := webauthncbor.Marshal(map[string]any{"fmt": "none", "attStmt": map[string]any{}, "authData": a.authData(attested)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"id":    b64.EncodeToString(a.id),
+		"rawId": b64.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(a.clientData("webauthn.create", creation.Response.Challenge)),
+			"attestationObject": b64.EncodeToString(object),
+		},
+	})
+	return body
+}
+
+// get signs the challenge of a login ceremony with the given counter.
+func (a *authenticator) get(t *testing.T, assertion *protocol.CredentialAssertion, count uint32) []byte {
+	a.count = count
+	auth := a.authData(nil)
+	client := a.clientData("webauthn.get", assertion.Response.Challenge)
+	clientHash := sha256.Sum256(client)
+	signed := sha256.Sum256(append(append([]byte{}, auth...), clientHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, signed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"id":    b64.EncodeToString(a.id),
+		"rawId": b64.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(client),
+			"authenticatorData": b64.EncodeToString(auth),
+			"signature":         b64.EncodeToString(sig),
+			"userHandle":        b64.EncodeToString(a.user),
+		},
+	})
+	return body
+}
+
+// fakeCredential is a webauthn_credentials row kept by a fakeDB.
+type fakeCredential struct {
+	id     int
+	userID int
+	credID string
+	name   string
+	data   []byte
+}
+
+// passkeyStore is the state behind the passkey tests: users 1 (alice) and
+// 2 (bob), their credentials and the failed logins recorded.
+type passkeyStore struct {
+	creds    []*fakeCredential
+	failures int
+}
+
+func usePasskeyStore(t *testing.T) *passkeyStore {
+	st := &passkeyStore{}
+	names := map[int]string{1: "alice", 2: "bob"}
+	f := useFakeDB(t)
+	f.handle("SELECT username FROM users WHERE id=?", func(args []driver.Value) (*fakeRows, int64) {
+		if name, ok := names[argInt(args[0])]; ok {
+			return rowsOf([]driver.Value{name}), 0
+		}
+		return nil, 0
+	})
+	f.handle("SELECT status FROM users WHERE id=?", func(args []driver.Value) (*fakeRows, int64) {
+		return rowsOf([]driver.Value{userActive}), 0
+	})
+	f.handle("SELECT data FROM webauthn_credentials WHERE user_id=?", func(args []driver.Value) (*fakeRows, int64) {
+		rows := rowsOf()
+		for _, c := range st.creds {
+			if c.userID == argInt(args[0]) {
+				rows.rows = append(rows.rows, []driver.Value{c.data})
+			}
+		}
+		return rows, 0
+	})
+	f.handle("INSERT INTO webauthn_credentials (user_id, credential_id, name, data, created_at) VALUES (?, ?, ?, ?, ?)", func(args []driver.Value) (*fakeRows, int64) {
+		st.creds = append(st.creds, &fakeCredential{id: len(st.creds) + 1, userID: argInt(args[0]), credID: args[1].(string), name: args[2].(string), data: args[3].([]byte)})
+		return nil, 1
+	})
+	f.handle("UPDATE webauthn_credentials SET data=?, last_used_at=? WHERE credential_id=?", func(args []driver.Value) (*fakeRows, int64) {
+		for _, c := range st.creds {
+			if c.credID == args[2].(string) {
+				c.data = args[0].([]byte)
+				return nil, 1
+			}
+		}
+		return nil, 0
+	})
+	f.handle("DELETE FROM webauthn_credentials WHERE id=? AND user_id=?", func(args []driver.Value) (*fakeRows, int64) {
+		for i, c := range st.creds {
+			if c.id == argInt(args[0]) && c.userID == argInt(args[1]) {
+				st.creds = append(st.creds[:i], st.creds[i+1:]...)
+				return nil, 1
+			}
+		}
+		return nil, 0
+	})
+	f.handle("INSERT INTO login_failures (username, ip, user_agent, reason, attempted_at) VALUES (?, ?, ?, ?, ?)", func(args []driver.Value) (*fakeRows, int64) {
+		st.failures++
+		return nil, 1
+	})
+	saved := sessions
+	sessions = &memorySessionStore{sessions: map[string]*Session{}}
+	t.Cleanup(func() { sessions = saved })
+	return st
+}
+
+// ceremonyStep posts body to handler, signed in as uid unless it is 0,
+// carrying over the ceremony cookie of the previous step.
+func ceremonyStep(handler http.HandlerFunc, target string, uid int, body []byte, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", target, bytes.NewReader(body))
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	if uid != 0 {
+		r = withSession(r, &Session{UserID: uid})
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func registerPasskey(t *testing.T, a *authenticator, uid int, name string) {
+	t.Helper()
+	w := ceremonyStep(passkeyRegisterBeginHandler, "/famoney/passkeys/register/begin", uid, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("register begin: %d %s", w.Code, w.Body)
+	}
+	var creation protocol.CredentialCreation
+	if err := json.Unmarshal(w.Body.Bytes(), &creation); err != nil {
+		t.Fatal(err)
+	}
+	w = ceremonyStep(passkeyRegisterFinishHandler, "/famoney/passkeys/register/finish?name="+url.QueryEscape(name), uid, a.create(t, &creation), w.Result().Cookies())
+	if w.Code != http.StatusOK {
+		t.Fatalf("register finish: %d %s", w.Code, w.Body)
+	}
+}
+
+// loginPasskey runs a discoverable login with the given counter and
+// returns the response of the finishing step.
+func loginPasskey(t *testing.T, a *authenticator, count uint32) *httptest.ResponseRecorder {
+	t.Helper()
+	w := ceremonyStep(passkeyLoginBeginHandler, "/famoney/login/passkey/begin", 0, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login begin: %d %s", w.Code, w.Body)
+	}
+	var assertion protocol.CredentialAssertion
+	if err := json.Unmarshal(w.Body.Bytes(), &assertion); err != nil {
+		t.Fatal(err)
+	}
+	return ceremonyStep(passkeyLoginFinishHandler, "/famoney/login/passkey/finish", 0, a.get(t, &assertion, count), w.Result().Cookies())
+}
+
+// loggedIn returns the user of the session a login response started, or 0.
+func loggedIn(w *httptest.ResponseRecorder) int {
+	for _, c := range w.Result().Cookies() {
+		if s, err := sessions.Get(c.Value); err == nil && s != nil {
+			return s.UserID
+		}
+	}
+	return 0
+}
+
+func TestPasskeyRegisterAndLogin(t *testing.T) {
+	st := usePasskeyStore(t)
+	a := newAuthenticator(t)
+	registerPasskey(t, a, 1, "Phone")
+	if len(st.creds) != 1 || st.creds[0].userID != 1 || st.creds[0].name != "Phone" {
+		t.Fatalf("stored credentials: %+v", st.creds)
+	}
+
+	w := loginPasskey(t, a, 1)
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte("/famoney/dashboard")) {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	if uid := loggedIn(w); uid != 1 {
+		t.Errorf("logged in as %d, want 1", uid)
+	}
+
+	// The ceremony cookie is single use.
+	w = ceremonyStep(passkeyLoginFinishHandler, "/famoney/login/passkey/finish", 0, nil, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("finish without a ceremony: %d", w.Code)
+	}
+}
+
+func TestPasskeySignCountRegression(t *testing.T) {
+	st := usePasskeyStore(t)
+	a := newAuthenticator(t)
+	registerPasskey(t, a, 1, "Key")
+	if w := loginPasskey(t, a, 5); w.Code != http.StatusOK {
+		t.Fatalf("login with counter 5: %d %s", w.Code, w.Body)
+	}
+	for _, count := range []uint32{5, 3} {
+		w := loginPasskey(t, a, count)
+		if w.Code != http.StatusBadRequest || loggedIn(w) != 0 {
+			t.Errorf("login with counter %d after 5: %d %s", count, w.Code, w.Body)
+		}
+	}
+	if st.failures != 2 {
+		t.Errorf("recorded %d failed logins, want 2", st.failures)
+	}
+	if w := loginPasskey(t, a, 6); w.Code != http.StatusOK {
+		t.Errorf("login with counter 6: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestPasskeyDeleteOtherUsersCredential(t *testing.T) {
+	st := usePasskeyStore(t)
+	registerPasskey(t, newAuthenticator(t), 1, "Alice's phone")
+	form := url.Values{"action": {"delete"}, "id": {strconv.Itoa(st.creds[0].id)}}
+	r := httptest.NewRequest("POST", "/famoney/passkeys", bytes.NewBufferString(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	passkeysHandler(w, withSession(r, &Session{UserID: 2}))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if len(st.creds) != 1 {
+		t.Fatal("bob deleted alice's passkey")
+	}
+
+	r = httptest.NewRequest("POST", "/famoney/passkeys", bytes.NewBufferString(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	passkeysHandler(httptest.NewRecorder(), withSession(r, &Session{UserID: 1}))
+	if len(st.creds) != 0 {
+		t.Error("alice could not delete her own passkey")
+	}
+}
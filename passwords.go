@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are stored as bcrypt hashes. Rows from before hashing was
+// introduced still hold the plaintext; they are accepted once and rehashed
+// on the next successful login, as are hashes made with a different cost.
+
+// bcrypt only hashes the first 72 bytes and refuses longer passwords.
+const (
+	minPasswordLen = 8
+	maxPasswordLen = 72
+)
+
+var (
+	errPassword   = errors.New("ErrPassword")
+	errPwMismatch = errors.New("ErrPwMismatch")
+	errPwShort    = errors.New("ErrPwShort")
+	errPwLong     = errors.New("ErrPwLong")
+	errUsername   = errors.New("ErrUsername")
+)
+
+// bcryptCost is read from BCRYPT_COST and defaults to bcrypt.DefaultCost.
+var bcryptCost = func() int {
+	v := os.Getenv("BCRYPT_COST")
+	if v == "" {
+		return bcrypt.DefaultCost
+	}
+	cost, err := strconv.Atoi(v)
+	if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		log.Printf("ignoring BCRYPT_COST=%q, using %d", v, bcrypt.DefaultCost)
+		return bcrypt.DefaultCost
+	}
+	return cost
+}()
+
+// dummyHash is compared against when the user does not exist so that a
+// failed login takes the same time either way.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("famoney"), bcrypt.DefaultCost)
+
+func hashPassword(pw string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(pw), bcryptCost)
+	return string(h), err
+}
+
+func isBcryptHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// checkPassword reports whether pw matches the stored value and whether
+// the stored value should be replaced by a fresh hash.
+func checkPassword(stored, pw string) (ok, rehash bool) {
+	if !isBcryptHash(stored) {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(pw)) == 1
+		return ok, ok
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(pw)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err != nil || cost != bcryptCost
+}
+
+// validatePassword checks a newly chosen password.
+func validatePassword(pw, confirm string) error {
+	if len(pw) < minPasswordLen {
+		return errPwShort
+	}
+	if len(pw) > maxPasswordLen {
+		return errPwLong
+	}
+	if pw != confirm {
+		return errPwMismatch
+	}
+	return nil
+}
+
+// authenticate returns the id of the user with the given credentials, or 0.
+// Plaintext and outdated hashes are upgraded on success.
+func authenticate(username, pw string) int {
+	var id int
+	var stored string
+	if err := db.QueryRow("SELECT id, password FROM users WHERE username=?", username).Scan(&id, &stored); err != nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(pw))
+		return 0
+	}
+	ok, rehash := checkPassword(stored, pw)
+	if !ok {
+		return 0
+	}
+	if rehash {
+		if h, err := hashPassword(pw); err == nil {
+			if _, err := db.Exec("UPDATE users SET password=? WHERE id=?", h, id); err != nil {
+				log.Println("failed to rehash password", err)
+			}
+		}
+	}
+	return id
+}
+
+// verifyPassword checks the password of a logged-in user before a
+// sensitive change.
+func verifyPassword(uid int, pw string) error {
+	var stored string
+	if err := db.QueryRow("SELECT password FROM users WHERE id=?", uid).Scan(&stored); err != nil {
+		return err
+	}
+	if ok, _ := checkPassword(stored, pw); !ok {
+		return errPassword
+	}
+	return nil
+}
+
+// changePassword replaces the password of uid after verifying the current one.
+func changePassword(uid int, current, pw, confirm string) error {
+	if err := verifyPassword(uid, current); err != nil {
+		return err
+	}
+	if err := validatePassword(pw, confirm); err != nil {
+		return err
+	}
+	h, err := hashPassword(pw)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE users SET password=? WHERE id=?", h, uid)
+	return err
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateProvider fetches a full set of exchange rates expressed as units of
+// each currency per one USD.
+type RateProvider interface {
+	Name() string
+	FetchRates() (map[string]float64, error)
+}
+
+var rateClient = &http.Client{Timeout: 30 * time.Second}
+
+// rebaseToUSD turns rates quoted against base into rates quoted against USD.
+func rebaseToUSD(rates map[string]float64, base string) (map[string]float64, error) {
+	rates[base] = 1
+	usd, ok := rates["USD"]
+	if !ok || usd <= 0 {
+		return nil, fmt.Errorf("no USD rate against %s", base)
+	}
+	out := make(map[string]float64, len(rates))
+	for cur, rate := range rates {
+		if rate > 0 {
+			out[cur] = rate / usd
+		}
+	}
+	out["USD"] = 1
+	return out, nil
+}
+
+// exchangeRateAPIProvider queries v6.exchangerate-api.com with an API key.
+type exchangeRateAPIProvider struct {
+	key string
+}
+
+func (p *exchangeRateAPIProvider) Name() string { return "exchangerate-api" }
+
+func (p *exchangeRateAPIProvider) FetchRates() (map[string]float64, error) {
+	resp, err := rateClient.Get("https://v6.exchangerate-api.com/v6/" + p.key + "/latest/USD")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var data struct {
+		Rates map[string]float64 `json:"conversion_rates"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	if len(data.Rates) == 0 {
+		return nil, errors.New("empty rate set")
+	}
+	return rebaseToUSD(data.Rates, "USD")
+}
+
+// ecbProvider reads the European Central Bank daily reference rates, which
+// are quoted against EUR and need no API key.
+type ecbProvider struct {
+	url string
+}
+
+func (p *ecbProvider) Name() string { return "ecb" }
+
+func (p *ecbProvider) FetchRates() (map[string]float64, error) {
+	resp, err := rateClient.Get(p.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var data struct {
+		Cube struct {
+			Cube struct {
+				Time  string `xml:"time,attr"`
+				Rates []struct {
+					Currency string  `xml:"currency,attr"`
+					Rate     float64 `xml:"rate,attr"`
+				} `xml:"Cube"`
+			} `xml:"Cube"`
+		} `xml:"Cube"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	rates := map[string]float64{}
+	for _, r := range data.Cube.Cube.Rates {
+		rates[r.Currency] = r.Rate
+	}
+	if len(rates) == 0 {
+		return nil, errors.New("empty rate set")
+	}
+	return rebaseToUSD(rates, "EUR")
+}
+
+// fileRatesProvider loads rates from a local file so the service can run
+// offline. JSON files hold {"base": "USD", "rates": {"CNY": 7.1, ...}};
+// CSV files hold currency,rate rows quoted per USD.
+type fileRatesProvider struct {
+	path string
+}
+
+func (p *fileRatesProvider) Name() string { return "file" }
+
+func (p *fileRatesProvider) FetchRates() (map[string]float64, error) {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(p.path), ".csv") {
+		records, err := csv.NewReader(f).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		rates := map[string]float64{}
+		for _, rec := range records {
+			if len(rec) < 2 {
+				continue
+			}
+			rate, err := strconv.ParseFloat(strings.TrimSpace(rec[1]), 64)
+			if err != nil {
+				continue // header or malformed row
+			}
+			rates[strings.ToUpper(strings.TrimSpace(rec[0]))] = rate
+		}
+		if len(rates) == 0 {
+			return nil, errors.New("empty rate set")
+		}
+		return rebaseToUSD(rates, "USD")
+	}
+	var data struct {
+		Base  string             `json:"base"`
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.NewDecoder(f).Decode(&data); err != nil {
+		return nil, err
+	}
+	if len(data.Rates) == 0 {
+		return nil, errors.New("empty rate set")
+	}
+	if data.Base == "" {
+		data.Base = "USD"
+	}
+	return rebaseToUSD(data.Rates, strings.ToUpper(data.Base))
+}
+
+// manualRatesProvider serves the rates maintained by hand on the rates page.
+type manualRatesProvider struct{}
+
+func (p *manualRatesProvider) Name() string { return "manual" }
+
+func (p *manualRatesProvider) FetchRates() (map[string]float64, error) {
+	rows, err := db.Query("SELECT currency, rate FROM manual_rates")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rates := map[string]float64{}
+	for rows.Next() {
+		var cur string
+		var rate float64
+		if err := rows.Scan(&cur, &rate); err == nil {
+			rates[cur] = rate
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(rates) == 0 {
+		return nil, errors.New("no manual rates")
+	}
+	return rebaseToUSD(rates, "USD")
+}
+
+// rateProviderChain tries each provider in turn and returns the first
+// successful rate set.
+type rateProviderChain []RateProvider
+
+func (c rateProviderChain) Name() string {
+	names := make([]string, len(c))
+	for i, p := range c {
+		names[i] = p.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (c rateProviderChain) FetchRates() (map[string]float64, error) {
+	_, rates, err := c.fetch()
+	return rates, err
+}
+
+// fetch is FetchRates that also reports which provider answered.
+func (c rateProviderChain) fetch() (RateProvider, map[string]float64, error) {
+	var errs []string
+	for _, p := range c {
+		rates, err := p.FetchRates()
+		if err == nil {
+			return p, rates, nil
+		}
+		errs = append(errs, p.Name()+": "+err.Error())
+	}
+	return nil, nil, fmt.Errorf("all rate providers failed: %s", strings.Join(errs, "; "))
+}
+
+// newRateProviders builds the provider chain from RATE_PROVIDERS, a comma
+// separated list in fallback order. Providers that are missing their
+// configuration (EXRATE_API, RATES_FILE) are skipped.
+func newRateProviders() rateProviderChain {
+	order := os.Getenv("RATE_PROVIDERS")
+	if order == "" {
+		order = "exchangerate-api,ecb,file,manual"
+	}
+	chain := rateProviderChain{}
+	for _, name := range strings.Split(order, ",") {
+		switch strings.TrimSpace(name) {
+		case "exchangerate-api":
+			if key := os.Getenv("EXRATE_API"); key != "" {
+				chain = append(chain, &exchangeRateAPIProvider{key: key})
+			}
+		case "ecb":
+			url := os.Getenv("ECB_RATES_URL")
+			if url == "" {
+				url = "https://www.ecb.europa.eu/stats/eurofxref/eurofxref-daily.xml"
+			}
+			chain = append(chain, &ecbProvider{url: url})
+		case "file":
+			if path := os.Getenv("RATES_FILE"); path != "" {
+				chain = append(chain, &fileRatesProvider{path: path})
+			}
+		case "manual":
+			chain = append(chain, &manualRatesProvider{})
+		}
+	}
+	return chain
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Valuation modes for reports: flows are converted to the base currency
+// either at today's rates or at the rates in effect when they were booked.
+const (
+	valuationCurrent    = "current"
+	valuationHistorical = "historical"
+)
+
+var (
+	rateHistoryMu sync.Mutex
+	rateHistory   = map[string]map[string]float64{}
+)
+
+// storeRates persists a fetched rate set (units per USD) under today's date
+// so that history survives restarts and old flows can be revalued.
+func storeRates(rates map[string]float64) {
+	day := time.Now().Format("2006-01-02")
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("failed to store currency rates", err)
+		return
+	}
+	defer tx.Rollback()
+	for cur, rate := range rates {
+		if _, err := tx.Exec("INSERT INTO exchange_rates (rate_date, currency, rate) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE rate=VALUES(rate)", day, cur, rate); err != nil {
+			log.Println("failed to store currency rates", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("failed to store currency rates", err)
+		return
+	}
+	rateHistoryMu.Lock()
+	delete(rateHistory, day)
+	rateHistoryMu.Unlock()
+}
+
+// ratesOn returns the most recent stored rate set on or before day, or nil
+// if nothing that old has been recorded. Past days are cached.
+func ratesOn(day time.Time) map[string]float64 {
+	key := day.Format("2006-01-02")
+	rateHistoryMu.Lock()
+	rates, ok := rateHistory[key]
+	rateHistoryMu.Unlock()
+	if ok {
+		return rates
+	}
+	rows, err := db.Query("SELECT currency, rate FROM exchange_rates WHERE rate_date=(SELECT MAX(rate_date) FROM exchange_rates WHERE rate_date<=?)", key)
+	if err != nil {
+		log.Println("failed to load currency rates", err)
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cur string
+		var rate float64
+		if err := rows.Scan(&cur, &rate); err == nil {
+			if rates == nil {
+				rates = map[string]float64{}
+			}
+			rates[cur] = rate
+		}
+	}
+	if key != time.Now().Format("2006-01-02") {
+		rateHistoryMu.Lock()
+		rateHistory[key] = rates
+		rateHistoryMu.Unlock()
+	}
+	return rates
+}
+
+// convertAt converts using the rates and the overrides of hid in effect on
+// day, falling back to today's rates for currencies with no recorded
+// history.
+func convertAt(hid int, amount float64, from, to string, day time.Time) float64 {
+	return convertWith(ratesOn(day), overridesOn(hid, day), amount, from, to)
+}
+
+// snapshotRate returns today's rate of cur per USD for recording on a new
+// flow, or nil when the rate is unknown.
+func snapshotRate(cur string) interface{} {
+	if rate, ok := getRates()[cur]; ok {
+		return rate
+	}
+	return nil
+}
+
+// flowTotal is the sum of one wallet's flows in a category, kind and
+// currency booked on a single day.
+type flowTotal struct {
+	WalletID   int
+	CategoryID int
+	Kind       string
+	Currency   string
+	Day        time.Time
+	Sum        int64
+	// SnappedUSD is the part of Sum recorded with a rate snapshot, already
+	// converted to USD at that snapshot; Unsnapped is the rest, still in
+	// minor units of Currency.
+	SnappedUSD float64
+	Unsnapped  int64
+}
+
+// Value converts the total to minor units of base according to the
+// valuation mode, applying the rate overrides of household hid.
+func (t *flowTotal) Value(hid int, base, mode string) int64 {
+	if mode != valuationHistorical {
+		return convertMoney(hid, t.Sum, t.Currency, base)
+	}
+	sum := toMajor(t.Sum, t.Currency)
+	if hasOverride(hid, t.Day, t.Currency, base) {
+		return fromMajor(convertAt(hid, sum, t.Currency, base, t.Day), base)
+	}
+	baseRate, ok := ratesOn(t.Day)[base]
+	if !ok {
+		baseRate, ok = getRates()[base]
+	}
+	if !ok {
+		return fromMajor(convertAt(hid, sum, t.Currency, base, t.Day), base)
+	}
+	unsnapped := convertAt(hid, toMajor(t.Unsnapped, t.Currency), t.Currency, base, t.Day)
+	return fromMajor(t.SnappedUSD*baseRate+unsnapped, base)
+}
+
+// queryFlowTotals returns per-day flow totals for the given wallets,
+// restricted to the given flow kinds when any are passed.
+func queryFlowTotals(walletIDs []int, kinds ...string) ([]*flowTotal, error) {
+	if len(walletIDs) == 0 {
+		return nil, nil
+	}
+	placeholders := make([]string, len(walletIDs))
+	args := make([]interface{}, 0, len(walletIDs)+len(kinds))
+	for i, id := range walletIDs {
+		placeholders[i] = "?"
+		args = append(args, id)
+	}
+	q := fmt.Sprintf("SELECT wallet_id, IFNULL(category_id, 0), kind, currency, DATE(created_at), SUM(amount), IFNULL(SUM(amount/usd_rate), 0), SUM(IF(usd_rate IS NULL, amount, 0)) FROM flows WHERE wallet_id IN (%s)", strings.Join(placeholders, ","))
+	if len(kinds) > 0 {
+		kp := make([]string, len(kinds))
+		for i, k := range kinds {
+			kp[i] = "?"
+			args = append(args, k)
+		}
+		q += fmt.Sprintf(" AND kind IN (%s)", strings.Join(kp, ","))
+	}
+	q += " GROUP BY wallet_id, category_id, kind, currency, DATE(created_at)"
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	totals := []*flowTotal{}
+	for rows.Next() {
+		t := &flowTotal{}
+		if err := rows.Scan(&t.WalletID, &t.CategoryID, &t.Kind, &t.Currency, &t.Day, &t.Sum, &t.SnappedUSD, &t.Unsnapped); err == nil {
+			t.SnappedUSD /= minorScale(t.Currency)
+			totals = append(totals, t)
+		}
+	}
+	return totals, rows.Err()
+}
+
+// snapshotRateAt is like snapshotRate but prefers the rate recorded for
+// day, used when an existing flow changes currency.
+func snapshotRateAt(cur string, day time.Time) interface{} {
+	if rate, ok := ratesOn(day)[cur]; ok {
+		return rate
+	}
+	return snapshotRate(cur)
+}
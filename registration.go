@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// REGISTRATION_MODE decides who may create an account:
+//
+//	open      anyone who can reach the register page (the default)
+//	invite    only holders of an unused invite link
+//	approval  anyone, but the account stays pending until an administrator
+//	          approves it; an invite link skips the approval
+//	closed    nobody
+//
+// Invites are single-use links created by administrators. An invite can
+// name a household and a wallet the new user is added to straight away,
+// as an editor of the wallet.
+
+const (
+	regOpen     = "open"
+	regInvite   = "invite"
+	regApproval = "approval"
+	regClosed   = "closed"
+
+	userActive   = "active"
+	userPending  = "pending"
+	userDisabled = "disabled"
+)
+
+var (
+	errRegClosed  = errors.New("ErrRegClosed")
+	errInvite     = errors.New("ErrInvite")
+	errInviteNeed = errors.New("ErrInviteNeed")
+	errPending    = errors.New("ErrPending")
+)
+
+var registrationMode = func() string {
+	switch v := strings.ToLower(os.Getenv("REGISTRATION_MODE")); v {
+	case "", regOpen:
+		return regOpen
+	case regInvite, regApproval, regClosed:
+		return v
+	default:
+		log.Printf("ignoring REGISTRATION_MODE=%q, using %s", v, regOpen)
+		return regOpen
+	}
+}()
+
+// Invite is a registration link as listed on the registrations page.
+type Invite struct {
+	ID            int
+	Note          string
+	HouseholdID   int
+	HouseholdName string
+	WalletID      int
+	WalletName    string
+	CreatedAt     time.Time
+	ExpiresAt     *time.Time
+	UsedBy        string
+	UsedAt        *time.Time
+}
+
+// Expired reports whether an unused invite can no longer be redeemed.
+func (i *Invite) Expired() bool {
+	return i.UsedAt == nil && i.ExpiresAt != nil && time.Now().After(*i.ExpiresAt)
+}
+
+// PendingUser is an account waiting for approval.
+type PendingUser struct {
+	ID        int
+	Username  string
+	CreatedAt *time.Time
+}
+
+func hashInvite(code string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// createInvite stores a new invite and returns its code, which is not kept
+// in clear text. householdID and walletID may be 0; ttl 0 means the invite
+// does not expire.
+func createInvite(uid int, note string, householdID, walletID int, ttl time.Duration) (string, error) {
+	if householdID != 0 && !isMember(uid, householdID) {
+		return "", errNotMember
+	}
+	if walletID != 0 && !hasRole(uid, walletID, roleOwner) {
+		return "", errRole
+	}
+	code, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	var hid, wid, expires interface{}
+	if householdID != 0 {
+		hid = householdID
+	}
+	if walletID != 0 {
+		wid = walletID
+	}
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+	_, err = db.Exec("INSERT INTO invites (code_hash, note, household_id, wallet_id, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)", hashInvite(code), note, hid, wid, uid, now, expires)
+	return code, err
+}
+
+func listInvites() ([]*Invite, error) {
+	rows, err := db.Query("SELECT i.id, i.note, IFNULL(i.household_id, 0), IFNULL(h.name, ''), IFNULL(i.wallet_id, 0), IFNULL(w.name, ''), i.created_at, i.expires_at, IFNULL(u.username, ''), i.used_at FROM invites i LEFT JOIN households h ON i.household_id=h.id LEFT JOIN wallets w ON i.wallet_id=w.id LEFT JOIN users u ON i.used_by=u.id ORDER BY i.created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*Invite{}
+	for rows.Next() {
+		i := &Invite{}
+		if err := rows.Scan(&i.ID, &i.Note, &i.HouseholdID, &i.HouseholdName, &i.WalletID, &i.WalletName, &i.CreatedAt, &i.ExpiresAt, &i.UsedBy, &i.UsedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, i)
+	}
+	return list, rows.Err()
+}
+
+func listPendingUsers() ([]*PendingUser, error) {
+	rows, err := db.Query("SELECT id, username, created_at FROM users WHERE status=? ORDER BY created_at, id", userPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*PendingUser{}
+	for rows.Next() {
+		p := &PendingUser{}
+		if err := rows.Scan(&p.ID, &p.Username, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+// registerUser creates an account according to the registration mode and
+// reports whether it has to wait for approval.
+func registerUser(username, pw, confirm, code string) (pending bool, err error) {
+	switch {
+	case registrationMode == regClosed:
+		return false, errRegClosed
+	case registrationMode == regInvite && code == "":
+		return false, errInviteNeed
+	}
+	if err := validatePassword(pw, confirm); err != nil {
+		return false, err
+	}
+	if username == "" {
+		return false, errUsername
+	}
+	hash, err := hashPassword(pw)
+	if err != nil {
+		return false, err
+	}
+	err = withTx(func(tx *sql.Tx) error {
+		now := time.Now()
+		var inviteID, householdID, walletID int
+		if code != "" {
+			err := tx.QueryRow("SELECT id, IFNULL(household_id, 0), IFNULL(wallet_id, 0) FROM invites WHERE code_hash=? AND used_at IS NULL AND (expires_at IS NULL OR expires_at > ?) FOR UPDATE", hashInvite(code), now).Scan(&inviteID, &householdID, &walletID)
+			if err == sql.ErrNoRows {
+				return errInvite
+			}
+			if err != nil {
+				return err
+			}
+		}
+		status := userActive
+		if registrationMode == regApproval && inviteID == 0 {
+			status = userPending
+		}
+		res, err := tx.Exec("INSERT INTO users (username, password, status, created_at) VALUES (?, ?, ?, ?)", username, hash, status, now)
+		if isDuplicate(err) {
+			return errUsername
+		}
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if inviteID != 0 {
+			if _, err := tx.Exec("UPDATE invites SET used_by=?, used_at=? WHERE id=?", id, now, inviteID); err != nil {
+				return err
+			}
+		}
+		if householdID != 0 {
+			if err := joinHousehold(tx, householdID, int(id)); err != nil {
+				return err
+			}
+		}
+		if walletID != 0 {
+			// A shared wallet is only visible to members of its household.
+			if _, err := tx.Exec("INSERT IGNORE INTO household_members (household_id, user_id, joined_at) SELECT household_id, ?, ? FROM wallets WHERE id=? AND household_id IS NOT NULL", id, now, walletID); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("INSERT IGNORE INTO wallet_owners (wallet_id, user_id, display_order, role) VALUES (?, ?, 1, ?)", walletID, id, roleEditor); err != nil {
+				return err
+			}
+		}
+		pending = status == userPending
+		return nil
+	})
+	return pending, err
+}
+
+// accountError returns why uid may not log in, or nil if it may.
+func accountError(uid int) error {
+	var status string
+	db.QueryRow("SELECT status FROM users WHERE id=?", uid).Scan(&status)
+	switch status {
+	case userActive:
+		return nil
+	case userPending:
+		return errPending
+	}
+	return errDisabled
+}
+
+// inviteURL is the link handed to the invitee.
+func inviteURL(r *http.Request, code string) string {
+	scheme := "http"
+	if secureCookies(r) {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/famoney/register?invite=%s", scheme, r.Host, code)
+}
+
+func registrationsHandler(w http.ResponseWriter, r *http.Request) {
+	uid := currentUser(r)
+	data := map[string]interface{}{}
+	if r.Method == "POST" {
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		var err error
+		switch r.FormValue("action") {
+		case "approve":
+			_, err = db.Exec("UPDATE users SET status=? WHERE id=? AND status=?", userActive, id, userPending)
+		case "reject":
+			_, err = db.Exec("DELETE FROM users WHERE id=? AND status=?", id, userPending)
+		case "revoke":
+			_, err = db.Exec("DELETE FROM invites WHERE id=? AND used_at IS NULL", id)
+		case "invite":
+			hid, _ := strconv.Atoi(r.FormValue("household"))
+			wid, _ := strconv.Atoi(r.FormValue("wallet"))
+			days, _ := strconv.Atoi(r.FormValue("days"))
+			var code string
+			if code, err = createInvite(uid, strings.TrimSpace(r.FormValue("note")), hid, wid, time.Duration(days)*24*time.Hour); err == nil {
+				data["InviteURL"] = inviteURL(r, code)
+			}
+		}
+		if err != nil {
+			data["Error"] = errorKey(err)
+		} else if data["InviteURL"] == nil {
+			http.Redirect(w, r, "/famoney/admin/registrations", http.StatusSeeOther)
+			return
+		}
+	}
+	pending, err := listPendingUsers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	invites, err := listInvites()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	households, err := userHouseholds(uid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	walletRows, err := db.Query("SELECT w.id, w.name FROM wallets w JOIN wallet_owners o ON w.id=o.wallet_id WHERE o.user_id=? AND o.role=? ORDER BY o.display_order, w.id", uid, roleOwner)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer walletRows.Close()
+	wallets := []*Wallet{}
+	for walletRows.Next() {
+		wl := &Wallet{}
+		if err := walletRows.Scan(&wl.ID, &wl.Name); err == nil {
+			wallets = append(wallets, wl)
+		}
+	}
+	data["Mode"] = registrationMode
+	data["Pending"] = pending
+	data["Invites"] = invites
+	data["Households"] = households
+	data["Wallets"] = wallets
+	render(w, r, "registrations.html", data)
+}
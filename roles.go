@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Everyone a wallet is shared with has a role on it, stored in
+// wallet_owners.role. Each role includes the rights of the ones below it:
+//
+//	owner        shares the wallet, assigns roles, renames and deletes it
+//	editor       books, edits and deletes flows, transfers and exchanges
+//	contributor  adds flows but cannot change existing ones
+//	viewer       only looks
+//
+// A wallet always keeps at least one owner.
+
+const (
+	roleOwner       = "owner"
+	roleEditor      = "editor"
+	roleContributor = "contributor"
+	roleViewer      = "viewer"
+)
+
+var roleRank = map[string]int{
+	roleViewer:      1,
+	roleContributor: 2,
+	roleEditor:      3,
+	roleOwner:       4,
+}
+
+// walletRoles lists the roles from most to least privileged for the share
+// form.
+var walletRoles = []string{roleOwner, roleEditor, roleContributor, roleViewer}
+
+// roleKeys maps roles to their translation keys.
+var roleKeys = map[string]string{
+	roleOwner:       "RoleOwner",
+	roleEditor:      "RoleEditor",
+	roleContributor: "RoleContributor",
+	roleViewer:      "RoleViewer",
+}
+
+var errRole = errors.New("ErrRole")
+
+// WalletMember is a user a wallet is shared with.
+type WalletMember struct {
+	UserID   int
+	Username string
+	Role     string
+}
+
+// walletRole returns the role of uid on wid, or "" without access.
+func walletRole(uid, wid int) string {
+	var role string
+	db.QueryRow("SELECT role FROM wallet_owners WHERE wallet_id=? AND user_id=?", wid, uid).Scan(&role)
+	return role
+}
+
+// hasRole reports whether uid has at least role min on wid.
+func hasRole(uid, wid int, min string) bool {
+	return roleRank[walletRole(uid, wid)] >= roleRank[min]
+}
+
+func walletMembers(wid int) ([]*WalletMember, error) {
+	rows, err := db.Query("SELECT u.id, u.username, o.role FROM users u JOIN wallet_owners o ON u.id=o.user_id WHERE o.wallet_id=? ORDER BY u.username", wid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*WalletMember{}
+	for rows.Next() {
+		m := &WalletMember{}
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role); err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+// lockOwners locks the memberships of wid, which are all scanned through
+// the primary key, and returns how many owners it has.
+func lockOwners(tx *sql.Tx, wid int) (int, error) {
+	var owners int
+	err := tx.QueryRow("SELECT COUNT(*) FROM wallet_owners WHERE wallet_id=? AND role=? FOR UPDATE", wid, roleOwner).Scan(&owners)
+	return owners, err
+}
+
+// shareWallet gives target the role on wid, or changes the role if the
+// wallet is already shared with them. Only owners may share, and the last
+// owner cannot be demoted.
+func shareWallet(uid, wid, target int, role string) error {
+	if _, ok := roleRank[role]; !ok {
+		return errRole
+	}
+	if !hasRole(uid, wid, roleOwner) {
+		return errRole
+	}
+	return withTx(func(tx *sql.Tx) error {
+		owners, err := lockOwners(tx, wid)
+		if err != nil {
+			return err
+		}
+		var current string
+		err = tx.QueryRow("SELECT role FROM wallet_owners WHERE wallet_id=? AND user_id=?", wid, target).Scan(&current)
+		switch {
+		case err == sql.ErrNoRows:
+			var order int
+			if err := tx.QueryRow("SELECT IFNULL(MAX(display_order), 0) + 1 FROM wallet_owners WHERE user_id=?", target).Scan(&order); err != nil {
+				return err
+			}
+			_, err = tx.Exec("INSERT INTO wallet_owners (wallet_id, user_id, display_order, role) VALUES (?, ?, ?, ?)", wid, target, order, role)
+			return err
+		case err != nil:
+			return err
+		}
+		if current == roleOwner && role != roleOwner && owners <= 1 {
+			return errLastOwner
+		}
+		_, err = tx.Exec("UPDATE wallet_owners SET role=? WHERE wallet_id=? AND user_id=?", role, wid, target)
+		return err
+	})
+}
+
+// unshareWallet removes target from wid. Owners may remove anyone and any
+// member may remove themselves, but never the last owner.
+func unshareWallet(uid, wid, target int) error {
+	if uid != target && !hasRole(uid, wid, roleOwner) {
+		return errRole
+	}
+	return withTx(func(tx *sql.Tx) error {
+		owners, err := lockOwners(tx, wid)
+		if err != nil {
+			return err
+		}
+		var role string
+		if err := tx.QueryRow("SELECT role FROM wallet_owners WHERE wallet_id=? AND user_id=?", wid, target).Scan(&role); err != nil {
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return err
+		}
+		if role == roleOwner && owners <= 1 {
+			return errLastOwner
+		}
+		_, err = tx.Exec("DELETE FROM wallet_owners WHERE wallet_id=? AND user_id=?", wid, target)
+		return err
+	})
+}
+
+// transferOwnership makes target, who must already share the wallet, its
+// owner and turns uid into an editor.
+func transferOwnership(uid, wid, target int) error {
+	if uid == target {
+		return nil
+	}
+	if !hasRole(uid, wid, roleOwner) {
+		return errRole
+	}
+	return withTx(func(tx *sql.Tx) error {
+		if _, err := lockOwners(tx, wid); err != nil {
+			return err
+		}
+		res, err := tx.Exec("UPDATE wallet_owners SET role=? WHERE wallet_id=? AND user_id=?", roleOwner, wid, target)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			var exists int
+			tx.QueryRow("SELECT COUNT(*) FROM wallet_owners WHERE wallet_id=? AND user_id=?", wid, target).Scan(&exists)
+			if exists == 0 {
+				return errNotMember
+			}
+		}
+		_, err = tx.Exec("UPDATE wallet_owners SET role=? WHERE wallet_id=? AND user_id=?", roleEditor, wid, uid)
+		return err
+	})
+}
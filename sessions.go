@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session is a logged-in browser. A session ends when it has been idle for
+// longer than the idle timeout or has existed for longer than the absolute
+// lifetime, whichever comes first.
+type Session struct {
+	ID        string
+	UserID    int
+	CreatedAt time.Time
+	LastSeen  time.Time
+	UserAgent string
+	IP        string
+	CSRFToken string
+}
+
+// Handle identifies the session on the sessions page without revealing the
+// cookie value.
+func (s *Session) Handle() string {
+	sum := sha256.Sum256([]byte(s.ID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// SessionStore keeps sessions between requests. Get returns nil for
+// unknown or expired sessions and records the access.
+type SessionStore interface {
+	Create(uid int, userAgent, ip string) (*Session, error)
+	Get(id string) (*Session, error)
+	Delete(id string) error
+	// List returns the live sessions of a user, most recently used first.
+	List(uid int) ([]*Session, error)
+	// DeleteUser ends every session of a user.
+	DeleteUser(uid int) error
+	// Sweep removes expired sessions and returns how many were removed.
+	Sweep() (int, error)
+}
+
+const sessionCookie = "session_id"
+
+var (
+	sessions SessionStore
+
+	sessionIdle     = envDuration("SESSION_IDLE", 7*24*time.Hour)
+	sessionLifetime = envDuration("SESSION_LIFETIME", 30*24*time.Hour)
+)
+
+// envDuration reads a duration such as "12h" from the environment.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("ignoring %s=%q, using %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newSession starts a session for uid with fresh id and CSRF token.
+func newSession(uid int, userAgent, ip string) (*Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	token, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &Session{ID: id, UserID: uid, CreatedAt: now, LastSeen: now, UserAgent: userAgent, IP: ip, CSRFToken: token}, nil
+}
+
+func (s *Session) expired(now time.Time) bool {
+	return now.Sub(s.LastSeen) > sessionIdle || now.Sub(s.CreatedAt) > sessionLifetime
+}
+
+// newSessionStore picks the store named by SESSION_STORE: "db" (the
+// default) survives restarts, "memory" does not.
+func newSessionStore() SessionStore {
+	if os.Getenv("SESSION_STORE") == "memory" {
+		return &memorySessionStore{sessions: map[string]*Session{}}
+	}
+	return &dbSessionStore{}
+}
+
+// sweepSessions periodically drops expired sessions.
+func sweepSessions(every time.Duration) {
+	for {
+		time.Sleep(every)
+		if n, err := sessions.Sweep(); err != nil {
+			log.Println("session sweep failed", err)
+		} else if n > 0 {
+			log.Printf("removed %d expired sessions", n)
+		}
+	}
+}
+
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func (m *memorySessionStore) Create(uid int, userAgent, ip string) (*Session, error) {
+	s, err := newSession(uid, userAgent, ip)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.sessions[s.ID] = s
+	m.mu.Unlock()
+	c := *s
+	return &c, nil
+}
+
+func (m *memorySessionStore) Get(id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	now := time.Now()
+	if s.expired(now) {
+		delete(m.sessions, id)
+		return nil, nil
+	}
+	s.LastSeen = now
+	c := *s
+	return &c, nil
+}
+
+func (m *memorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memorySessionStore) List(uid int) ([]*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	list := []*Session{}
+	for _, s := range m.sessions {
+		if s.UserID == uid && !s.expired(now) {
+			c := *s
+			list = append(list, &c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list, nil
+}
+
+func (m *memorySessionStore) DeleteUser(uid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, s := range m.sessions {
+		if s.UserID == uid {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (m *memorySessionStore) Sweep() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for id, s := range m.sessions {
+		if s.expired(now) {
+			delete(m.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// dbSessionStore keeps sessions in the sessions table. last_seen is only
+// written when it is more than a minute old to spare a write per request.
+type dbSessionStore struct{}
+
+func (d *dbSessionStore) Create(uid int, userAgent, ip string) (*Session, error) {
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	s, err := newSession(uid, userAgent, ip)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("INSERT INTO sessions (id, user_id, created_at, last_seen, user_agent, ip, csrf_token) VALUES (?, ?, ?, ?, ?, ?, ?)", s.ID, s.UserID, s.CreatedAt, s.LastSeen, s.UserAgent, s.IP, s.CSRFToken); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (d *dbSessionStore) Get(id string) (*Session, error) {
+	s := &Session{ID: id}
+	err := db.QueryRow("SELECT user_id, created_at, last_seen, IFNULL(user_agent, ''), IFNULL(ip, ''), IFNULL(csrf_token, '') FROM sessions WHERE id=?", id).Scan(&s.UserID, &s.CreatedAt, &s.LastSeen, &s.UserAgent, &s.IP, &s.CSRFToken)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if s.expired(now) {
+		return nil, d.Delete(id)
+	}
+	if s.CSRFToken == "" {
+		// Sessions created before CSRF protection get a token on first use.
+		if s.CSRFToken, err = newSessionID(); err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec("UPDATE sessions SET csrf_token=? WHERE id=?", s.CSRFToken, id); err != nil {
+			return nil, err
+		}
+	}
+	if now.Sub(s.LastSeen) > time.Minute {
+		s.LastSeen = now
+		if _, err := db.Exec("UPDATE sessions SET last_seen=? WHERE id=?", now, id); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (d *dbSessionStore) Delete(id string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE id=?", id)
+	return err
+}
+
+func (d *dbSessionStore) List(uid int) ([]*Session, error) {
+	now := time.Now()
+	rows, err := db.Query("SELECT id, created_at, last_seen, IFNULL(user_agent, ''), IFNULL(ip, '') FROM sessions WHERE user_id=? AND last_seen >= ? AND created_at >= ? ORDER BY last_seen DESC", uid, now.Add(-sessionIdle), now.Add(-sessionLifetime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*Session{}
+	for rows.Next() {
+		s := &Session{UserID: uid}
+		if err := rows.Scan(&s.ID, &s.CreatedAt, &s.LastSeen, &s.UserAgent, &s.IP); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+func (d *dbSessionStore) DeleteUser(uid int) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE user_id=?", uid)
+	return err
+}
+
+func (d *dbSessionStore) Sweep() (int, error) {
+	now := time.Now()
+	res, err := db.Exec("DELETE FROM sessions WHERE last_seen < ? OR created_at < ?", now.Add(-sessionIdle), now.Add(-sessionLifetime))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// secureCookies reports whether cookies should carry the Secure flag.
+// COOKIE_SECURE=true/false forces it; otherwise it follows whether the
+// request arrived over HTTPS, directly or through a proxy.
+func secureCookies(r *http.Request) bool {
+	switch strings.ToLower(os.Getenv("COOKIE_SECURE")) {
+	case "true", "1":
+		return true
+	case "false", "0":
+		return false
+	}
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, s *Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    s.ID,
+		Path:     "/",
+		MaxAge:   int(sessionLifetime / time.Second),
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clientIP returns the address of the browser. Forwarding headers are only
+// trusted from a proxy on the same host, as in the nginx setup from the
+// README.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if real := r.Header.Get("X-Real-IP"); real != "" {
+			return real
+		}
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	return host
+}
+
+type sessionCtxKey struct{}
+
+// requestSession returns the session of a request, looking it up in the
+// store unless auth already did.
+func requestSession(r *http.Request) *Session {
+	if s, ok := r.Context().Value(sessionCtxKey{}).(*Session); ok {
+		return s
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	s, err := sessions.Get(cookie.Value)
+	if err != nil {
+		log.Println("session lookup failed", err)
+		return nil
+	}
+	return s
+}
+
+// currentUser returns the id of the logged-in user, or 0.
+func currentUser(r *http.Request) int {
+	if s := requestSession(r); s != nil {
+		return s.UserID
+	}
+	return 0
+}
+
+func withSession(r *http.Request, s *Session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionCtxKey{}, s))
+}
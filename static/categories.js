@@ -0,0 +1,35 @@
+// Drill-down for category reports. Rows of subcategories carry the id of
+// their parent in data-parent and start hidden; the toggle on a parent row
+// shows its direct children or hides its whole subtree.
+(function() {
+  function setToggle(toggle, open) {
+    toggle.setAttribute('aria-expanded', open ? 'true' : 'false');
+    toggle.innerHTML = open ? '&#9662;' : '&#9656;';
+  }
+  function children(cid) {
+    return document.querySelectorAll('.category-item[data-parent="' + cid + '"]');
+  }
+  function hide(cid) {
+    children(cid).forEach(function(el) {
+      el.classList.add('d-none');
+      var toggle = el.querySelector('.category-toggle');
+      if (toggle) setToggle(toggle, false);
+      hide(el.dataset.cid);
+    });
+  }
+  document.addEventListener('DOMContentLoaded', function() {
+    document.querySelectorAll('.category-toggle').forEach(function(toggle) {
+      toggle.addEventListener('click', function(e) {
+        e.stopPropagation();
+        var cid = this.dataset.cid;
+        if (this.getAttribute('aria-expanded') === 'true') {
+          hide(cid);
+          setToggle(this, false);
+          return;
+        }
+        children(cid).forEach(function(el) { el.classList.remove('d-none'); });
+        setToggle(this, true);
+      });
+    });
+  });
+})();
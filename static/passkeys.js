@@ -0,0 +1,82 @@
+// WebAuthn ceremonies for the passkeys page and the login page. The server
+// sends and expects binary fields as unpadded base64url strings.
+(function() {
+  function fromB64(s) {
+    s = s.replace(/-/g, '+').replace(/_/g, '/');
+    while (s.length % 4) s += '=';
+    var bin = atob(s), buf = new Uint8Array(bin.length);
+    for (var i = 0; i < bin.length; i++) buf[i] = bin.charCodeAt(i);
+    return buf.buffer;
+  }
+  function toB64(buf) {
+    var bytes = new Uint8Array(buf), bin = '';
+    for (var i = 0; i < bytes.length; i++) bin += String.fromCharCode(bytes[i]);
+    return btoa(bin).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+  }
+  function headers() {
+    var h = {'Content-Type': 'application/json'};
+    var meta = document.querySelector('meta[name="csrf-token"]');
+    if (meta) h['X-CSRF-Token'] = meta.content;
+    return h;
+  }
+  function post(url, body) {
+    return fetch(url, {method: 'POST', headers: headers(), body: body ? JSON.stringify(body) : null})
+      .then(function(res) {
+        return res.json().then(function(data) {
+          if (!res.ok) throw new Error(data.error || res.statusText);
+          return data;
+        });
+      });
+  }
+  function showError(el, err) {
+    if (!el) return;
+    el.textContent = err.message || err;
+    el.classList.remove('d-none');
+  }
+
+  window.registerPasskey = function(name, errorEl) {
+    post('/famoney/passkeys/register/begin').then(function(opts) {
+      var pk = opts.publicKey;
+      pk.challenge = fromB64(pk.challenge);
+      pk.user.id = fromB64(pk.user.id);
+      (pk.excludeCredentials || []).forEach(function(c) { c.id = fromB64(c.id); });
+      return navigator.credentials.create(opts);
+    }).then(function(cred) {
+      return post('/famoney/passkeys/register/finish?name=' + encodeURIComponent(name), {
+        id: cred.id,
+        rawId: toB64(cred.rawId),
+        type: cred.type,
+        response: {
+          attestationObject: toB64(cred.response.attestationObject),
+          clientDataJSON: toB64(cred.response.clientDataJSON),
+          transports: cred.response.getTransports ? cred.response.getTransports() : []
+        }
+      });
+    }).then(function(res) {
+      window.location = res.redirect;
+    }).catch(function(err) { showError(errorEl, err); });
+  };
+
+  window.loginWithPasskey = function(errorEl) {
+    post('/famoney/login/passkey/begin').then(function(opts) {
+      var pk = opts.publicKey;
+      pk.challenge = fromB64(pk.challenge);
+      (pk.allowCredentials || []).forEach(function(c) { c.id = fromB64(c.id); });
+      return navigator.credentials.get(opts);
+    }).then(function(cred) {
+      return post('/famoney/login/passkey/finish', {
+        id: cred.id,
+        rawId: toB64(cred.rawId),
+        type: cred.type,
+        response: {
+          authenticatorData: toB64(cred.response.authenticatorData),
+          clientDataJSON: toB64(cred.response.clientDataJSON),
+          signature: toB64(cred.response.signature),
+          userHandle: cred.response.userHandle ? toB64(cred.response.userHandle) : null
+        }
+      });
+    }).then(function(res) {
+      window.location = res.redirect;
+    }).catch(function(err) { showError(errorEl, err); });
+  };
+})();
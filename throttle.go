@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failed logins are counted per username and per client IP. After a few
+// free attempts each further failure doubles the wait before the next try,
+// and once the limit is reached the key is locked out for loginLockout.
+// An IP gets more room than a username because a household may share one
+// address. Counters live in memory; every failure is also written to
+// login_failures for auditing.
+
+const loginFreeAttempts = 3
+
+var (
+	errLogin     = errors.New("ErrLogin")
+	errThrottled = errors.New("ErrThrottled")
+
+	loginMaxFailures = envInt("LOGIN_MAX_FAILURES", 10)
+	loginLockout     = envDuration("LOGIN_LOCKOUT", 15*time.Minute)
+)
+
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("ignoring %s=%q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+type loginAttempts struct {
+	failures int
+	last     time.Time
+	blocked  time.Time // no attempts before this instant
+}
+
+type loginLimiter struct {
+	mu   sync.Mutex
+	keys map[string]*loginAttempts
+}
+
+var loginThrottle = &loginLimiter{keys: map[string]*loginAttempts{}}
+
+func throttleKeys(username, ip string) (userKey, ipKey string) {
+	return "user:" + strings.ToLower(strings.TrimSpace(username)), "ip:" + ip
+}
+
+// limitFor returns the failure limit for a key.
+func limitFor(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return loginMaxFailures * 3
+	}
+	return loginMaxFailures
+}
+
+// wait reports how long the client has to wait before trying to log in
+// as username, or zero if it may try now.
+func (l *loginLimiter) wait(username, ip string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	userKey, ipKey := throttleKeys(username, ip)
+	for _, key := range []string{userKey, ipKey} {
+		if a, ok := l.keys[key]; ok && a.blocked.After(now) {
+			if d := a.blocked.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt against both keys.
+func (l *loginLimiter) fail(username, ip string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	userKey, ipKey := throttleKeys(username, ip)
+	for _, key := range []string{userKey, ipKey} {
+		a, ok := l.keys[key]
+		if !ok || now.Sub(a.last) > loginLockout {
+			a = &loginAttempts{}
+			l.keys[key] = a
+		}
+		a.failures++
+		a.last = now
+		switch {
+		case a.failures >= limitFor(key):
+			a.blocked = now.Add(loginLockout)
+		case a.failures > loginFreeAttempts:
+			backoff := time.Second << (a.failures - loginFreeAttempts - 1)
+			if backoff > loginLockout {
+				backoff = loginLockout
+			}
+			a.blocked = now.Add(backoff)
+		}
+	}
+	if len(l.keys) > 10000 {
+		for key, a := range l.keys {
+			if now.Sub(a.last) > loginLockout && !a.blocked.After(now) {
+				delete(l.keys, key)
+			}
+		}
+	}
+}
+
+// succeed clears the counters after a successful login.
+func (l *loginLimiter) succeed(username, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	userKey, ipKey := throttleKeys(username, ip)
+	delete(l.keys, userKey)
+	delete(l.keys, ipKey)
+}
+
+// auditLoginFailure records a failed or refused login attempt.
+func auditLoginFailure(username, ip, userAgent, reason string) {
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	if len(username) > 255 {
+		username = username[:255]
+	}
+	if _, err := db.Exec("INSERT INTO login_failures (username, ip, user_agent, reason, attempted_at) VALUES (?, ?, ?, ?, ?)", username, ip, userAgent, reason, time.Now()); err != nil {
+		log.Println("failed to record login failure", err)
+	}
+}
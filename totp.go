@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Two-factor authentication with RFC 6238 time-based one-time passwords
+// (SHA-1, 30 second steps, 6 digits), the parameters every authenticator
+// app supports. All functions take the current time as an argument so that
+// they can be checked against the RFC test vectors with a fixed clock.
+
+const (
+	totpStep      = 30 * time.Second
+	totpDigits    = 6
+	totpSkew      = 1 // accepted steps before and after the current one
+	totpIssuer    = "FaMoney"
+	recoveryCount = 10
+)
+
+var (
+	errTOTPCode   = errors.New("ErrTOTPCode")
+	errTOTPActive = errors.New("ErrTOTPActive")
+)
+
+// clock is the time source for two-factor checks.
+var clock = time.Now
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random 160-bit secret in base32.
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// hotp computes the RFC 4226 one-time password for a counter.
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, code%mod)
+}
+
+func totpCounter(t time.Time) uint64 {
+	return uint64(t.Unix() / int64(totpStep/time.Second))
+}
+
+// totpCode returns the code for secret at time t.
+func totpCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, totpCounter(t)), nil
+}
+
+// verifyTOTP checks code against the steps around t and returns the step
+// it matched. Steps at or before lastStep are rejected so that a code can
+// only be used once.
+func verifyTOTP(secret, code string, t time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	now := int64(totpCounter(t))
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep || step < 0 {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step))), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the otpauth:// URI encoded in the enrollment QR code.
+func totpURI(secret, username string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(int(totpStep/time.Second)))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + v.Encode()
+}
+
+// totpQR renders the enrollment URI as an inline PNG image.
+func totpQR(uri string) (template.URL, error) {
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)), nil
+}
+
+// newRecoveryCodes returns fresh one-time codes formatted as xxxxx-xxxxx.
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// TOTPState is a user's two-factor configuration.
+type TOTPState struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+func loadTOTP(uid int) (*TOTPState, error) {
+	st := &TOTPState{}
+	err := db.QueryRow("SELECT IFNULL(totp_secret, ''), totp_enabled, IFNULL(totp_last_step, 0) FROM users WHERE id=?", uid).Scan(&st.Secret, &st.Enabled, &st.LastStep)
+	return st, err
+}
+
+// startTOTPEnrollment stores a new, not yet enabled secret for uid.
+func startTOTPEnrollment(uid int) (string, error) {
+	st, err := loadTOTP(uid)
+	if err != nil {
+		return "", err
+	}
+	if st.Enabled {
+		return "", errTOTPActive
+	}
+	if st.Secret != "" {
+		return st.Secret, nil
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec("UPDATE users SET totp_secret=?, totp_last_step=NULL WHERE id=? AND totp_enabled=0", secret, uid)
+	return secret, err
+}
+
+// enableTOTP turns on two-factor login once the user proves the app is set
+// up, returning the recovery codes to show exactly once.
+func enableTOTP(uid int, code string) ([]string, error) {
+	st, err := loadTOTP(uid)
+	if err != nil {
+		return nil, err
+	}
+	if st.Enabled {
+		return nil, errTOTPActive
+	}
+	step, ok := verifyTOTP(st.Secret, code, clock(), st.LastStep)
+	if st.Secret == "" || !ok {
+		return nil, errTOTPCode
+	}
+	var codes []string
+	err = withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE users SET totp_enabled=1, totp_last_step=? WHERE id=?", step, uid); err != nil {
+			return err
+		}
+		codes, err = storeRecoveryCodes(tx, uid)
+		return err
+	})
+	return codes, err
+}
+
+func storeRecoveryCodes(tx *sql.Tx, uid int) ([]string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id=?", uid); err != nil {
+		return nil, err
+	}
+	for _, c := range codes {
+		if _, err := tx.Exec("INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES (?, ?)", uid, hashRecoveryCode(c)); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// regenerateRecoveryCodes replaces all recovery codes of uid.
+func regenerateRecoveryCodes(uid int) ([]string, error) {
+	var codes []string
+	err := withTx(func(tx *sql.Tx) error {
+		var err error
+		codes, err = storeRecoveryCodes(tx, uid)
+		return err
+	})
+	return codes, err
+}
+
+// disableTOTP turns two-factor login off and forgets the secret.
+func disableTOTP(uid int) error {
+	return withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE users SET totp_enabled=0, totp_secret=NULL, totp_last_step=NULL WHERE id=?", uid); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id=?", uid)
+		return err
+	})
+}
+
+func remainingRecoveryCodes(uid int) int {
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM totp_recovery_codes WHERE user_id=? AND used_at IS NULL", uid).Scan(&n)
+	return n
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused
+// recovery code for uid and consumes it.
+func checkSecondFactor(uid int, code string) error {
+	return withTx(func(tx *sql.Tx) error {
+		var secret string
+		var lastStep int64
+		if err := tx.QueryRow("SELECT IFNULL(totp_secret, ''), IFNULL(totp_last_step, 0) FROM users WHERE id=? FOR UPDATE", uid).Scan(&secret, &lastStep); err != nil {
+			return err
+		}
+		if step, ok := verifyTOTP(secret, code, clock(), lastStep); ok {
+			_, err := tx.Exec("UPDATE users SET totp_last_step=? WHERE id=?", step, uid)
+			return err
+		}
+		res, err := tx.Exec("UPDATE totp_recovery_codes SET used_at=? WHERE user_id=? AND code_hash=? AND used_at IS NULL", clock(), uid, hashRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errTOTPCode
+		}
+		return nil
+	})
+}
+
+// totpRequired reports whether uid has to pass the second login step.
+func totpRequired(uid int) bool {
+	var enabled bool
+	db.QueryRow("SELECT totp_enabled FROM users WHERE id=?", uid).Scan(&enabled)
+	return enabled
+}
+
+// pendingLogin is a user who passed the password check and still has to
+// enter a TOTP or recovery code.
+type pendingLogin struct {
+	UserID   int
+	Username string
+	Expires  time.Time
+}
+
+const (
+	pendingCookie = "login_pending"
+	pendingTTL    = 5 * time.Minute
+)
+
+var (
+	pendingMu     sync.Mutex
+	pendingLogins = map[string]*pendingLogin{}
+)
+
+func addPendingLogin(uid int, username string) (string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	now := clock()
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	for k, p := range pendingLogins {
+		if now.After(p.Expires) {
+			delete(pendingLogins, k)
+		}
+	}
+	pendingLogins[id] = &pendingLogin{UserID: uid, Username: username, Expires: now.Add(pendingTTL)}
+	return id, nil
+}
+
+func getPendingLogin(id string) *pendingLogin {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	p, ok := pendingLogins[id]
+	if !ok || clock().After(p.Expires) {
+		delete(pendingLogins, id)
+		return nil
+	}
+	return p
+}
+
+func dropPendingLogin(id string) {
+	pendingMu.Lock()
+	delete(pendingLogins, id)
+	pendingMu.Unlock()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of RFC 4226 and RFC 6238,
+// "12345678901234567890", in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestHOTPVectors(t *testing.T) {
+	// RFC 4226 Appendix D.
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for i, code := range want {
+		if got := hotp([]byte("12345678901234567890"), uint64(i)); got != code {
+			t.Errorf("hotp(%d) = %s, want %s", i, got, code)
+		}
+	}
+}
+
+func TestTOTPVectors(t *testing.T) {
+	// RFC 6238 Appendix B, SHA-1. The RFC lists 8 digit codes; ours are
+	// their last 6 digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		now := time.Unix(tt.unix, 0)
+		want := tt.code[2:]
+		if got, err := totpCode(rfcSecret, now); err != nil || got != want {
+			t.Errorf("totpCode at %d = %s, %v; want %s", tt.unix, got, err, want)
+		}
+		step, ok := verifyTOTP(rfcSecret, want, now, 0)
+		if !ok || step != tt.unix/30 {
+			t.Errorf("verifyTOTP at %d = %d, %v; want %d, true", tt.unix, step, ok, tt.unix/30)
+		}
+	}
+}
+
+func TestVerifyTOTPWindow(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := int64(totpCounter(now))
+	for offset := int64(-3); offset <= 3; offset++ {
+		code := hotp([]byte("12345678901234567890"), uint64(current+offset))
+		step, ok := verifyTOTP(rfcSecret, code, now, 0)
+		want := offset >= -totpSkew && offset <= totpSkew
+		if ok != want {
+			t.Errorf("step %+d accepted = %v, want %v", offset, ok, want)
+		}
+		if ok && step != current+offset {
+			t.Errorf("step %+d matched step %d", offset, step)
+		}
+	}
+}
+
+func TestVerifyTOTPRejectsUsedStep(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, _ := totpCode(rfcSecret, now)
+	step, ok := verifyTOTP(rfcSecret, code, now, 0)
+	if !ok {
+		t.Fatal("current code rejected")
+	}
+	if _, ok := verifyTOTP(rfcSecret, code, now, step); ok {
+		t.Error("code accepted again after its step was used")
+	}
+	previous, _ := totpCode(rfcSecret, now.Add(-totpStep))
+	if _, ok := verifyTOTP(rfcSecret, previous, now, step); ok {
+		t.Error("code of an earlier step accepted after a later one was used")
+	}
+	if _, ok := verifyTOTP(rfcSecret, "12345", now, 0); ok {
+		t.Error("short code accepted")
+	}
+}
+
+// fakeTOTPUser is the two-factor state of user 1 kept by a fakeDB.
+type fakeTOTPUser struct {
+	secret   string
+	enabled  bool
+	lastStep int64
+	// recovery maps code hashes to whether they have been used.
+	recovery map[string]bool
+}
+
+func useFakeTOTPUser(t *testing.T, secret string) *fakeTOTPUser {
+	u := &fakeTOTPUser{secret: secret, recovery: map[string]bool{}}
+	f := useFakeDB(t)
+	f.handle("SELECT IFNULL(totp_secret, ''), totp_enabled, IFNULL(totp_last_step, 0) FROM users WHERE id=?", func(args []driver.Value) (*fakeRows, int64) {
+		return rowsOf([]driver.Value{u.secret, u.enabled, u.lastStep}), 0
+	})
+	f.handle("UPDATE users SET totp_enabled=1, totp_last_step=? WHERE id=?", func(args []driver.Value) (*fakeRows, int64) {
+		u.enabled, u.lastStep = true, args[0].(int64)
+		return nil, 1
+	})
+	f.handle("DELETE FROM totp_recovery_codes WHERE user_id=?", func(args []driver.Value) (*fakeRows, int64) {
+		n := len(u.recovery)
+		u.recovery = map[string]bool{}
+		return nil, int64(n)
+	})
+	f.handle("INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES (?, ?)", func(args []driver.Value) (*fakeRows, int64) {
+		u.recovery[args[1].(string)] = false
+		return nil, 1
+	})
+	f.handle("SELECT IFNULL(totp_secret, ''), IFNULL(totp_last_step, 0) FROM users WHERE id=? FOR UPDATE", func(args []driver.Value) (*fakeRows, int64) {
+		return rowsOf([]driver.Value{u.secret, u.lastStep}), 0
+	})
+	f.handle("UPDATE users SET totp_last_step=? WHERE id=?", func(args []driver.Value) (*fakeRows, int64) {
+		u.lastStep = args[0].(int64)
+		return nil, 1
+	})
+	f.handle("UPDATE totp_recovery_codes SET used_at=? WHERE user_id=? AND code_hash=? AND used_at IS NULL", func(args []driver.Value) (*fakeRows, int64) {
+		hash := args[2].(string)
+		if used, ok := u.recovery[hash]; !ok || used {
+			return nil, 0
+		}
+		u.recovery[hash] = true
+		return nil, 1
+	})
+	return u
+}
+
+// pinClock fixes the two-factor clock at now until the test ends.
+func pinClock(t *testing.T, now time.Time) {
+	saved := clock
+	clock = func() time.Time { return now }
+	t.Cleanup(func() { clock = saved })
+}
+
+func TestSecondFactorSingleUse(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	pinClock(t, now)
+	u := useFakeTOTPUser(t, rfcSecret)
+
+	enrolled, _ := totpCode(rfcSecret, now)
+	codes, err := enableTOTP(1, enrolled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.enabled || len(codes) != recoveryCount || len(u.recovery) != recoveryCount {
+		t.Fatalf("enabled %v with %d codes, %d stored", u.enabled, len(codes), len(u.recovery))
+	}
+	if err := checkSecondFactor(1, enrolled); err != errTOTPCode {
+		t.Errorf("enrollment code reused: %v", err)
+	}
+
+	pinClock(t, now.Add(totpStep))
+	next, _ := totpCode(rfcSecret, now.Add(totpStep))
+	if err := checkSecondFactor(1, next); err != nil {
+		t.Errorf("next code rejected: %v", err)
+	}
+	if err := checkSecondFactor(1, next); err != errTOTPCode {
+		t.Errorf("code replayed: %v", err)
+	}
+
+	if err := checkSecondFactor(1, codes[0]); err != nil {
+		t.Errorf("recovery code rejected: %v", err)
+	}
+	if err := checkSecondFactor(1, codes[0]); err != errTOTPCode {
+		t.Errorf("recovery code used twice: %v", err)
+	}
+	if err := checkSecondFactor(1, " "+codes[1][:5]+codes[1][6:]+" "); err != nil {
+		t.Errorf("recovery code without dash rejected: %v", err)
+	}
+	if err := checkSecondFactor(1, "aaaaa-bbbbb"); err != errTOTPCode {
+		t.Errorf("unknown recovery code: %v", err)
+	}
+}